@@ -0,0 +1,282 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package gitea
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Session describes a temporary user created by a NewUser request
+type Session struct {
+	// Username is the name of the user (GITEA_USERNAME)
+	Username string
+
+	// PrivateKey and PublicKey are the user's ssh key pair (GITEA_PRIV_KEY,
+	// GITEA_PUB_KEY)
+	PrivateKey string
+	PublicKey  string
+
+	// KeyScan is the ssh-keyscan output for the Gitea instance
+	// (GITEA_KEYSCAN)
+	KeyScan string
+
+	// Repos maps the Var of each requested Repo to the path of the
+	// repository created, e.g. gopher.live/u123/mod1
+	Repos map[string]string
+
+	// Env holds all the variables returned, including those above and the
+	// GoEnv variables if requested, keyed by name
+	Env map[string]string
+}
+
+// Error is the error returned by Client for a request that fails with an
+// HTTP error status
+type Error struct {
+	// StatusCode is the HTTP status code of the response
+	StatusCode int
+
+	// Message is the error message returned by the server
+	Message string
+
+	// RequestID is the ID of the request, for correlation with the server
+	// logs
+	RequestID string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%v %v: %v", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+	if e.RequestID != "" {
+		msg += " (request " + e.RequestID + ")"
+	}
+	return msg
+}
+
+// temporary reports whether the request may succeed if retried, which is the
+// case when the server is starting up or unavailable
+func (e *Error) temporary() bool {
+	switch e.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Client is a client for the HTTP API of gitea serve. Its methods are safe
+// for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	timeout    time.Duration
+	retries    int
+	retryDelay time.Duration
+}
+
+// A ClientOption configures a Client
+type ClientOption func(*Client)
+
+// WithHTTPClient sets the HTTP client used to make requests. The default is
+// http.DefaultClient.
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithTimeout sets the time allowed for each attempt at a request. The
+// default is two minutes.
+func WithTimeout(d time.Duration) ClientOption {
+	return func(c *Client) { c.timeout = d }
+}
+
+// WithRetries sets the number of times a request is retried if the server
+// cannot be reached or is unavailable, and the delay before the first retry,
+// which doubles with each subsequent retry. The default is 3 retries starting
+// at one second.
+func WithRetries(n int, delay time.Duration) ClientOption {
+	return func(c *Client) {
+		c.retries = n
+		c.retryDelay = delay
+	}
+}
+
+// NewClient returns a client for the gitea serve instance at baseURL, e.g.
+// http://cmd_gitea:8080
+func NewClient(baseURL string, opts ...ClientOption) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		timeout:    2 * time.Minute,
+		retries:    3,
+		retryDelay: time.Second,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// NewUser creates a temporary user, with the repositories described by spec.
+// All attempts at the request carry the same Idempotency-Key header, such
+// that if the server created the user but the response was lost, a retry
+// returns that user rather than creating another.
+func (c *Client) NewUser(ctx context.Context, spec NewUser) (*Session, error) {
+	body, err := json.Marshal(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %v", err)
+	}
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate idempotency key: %v", err)
+	}
+	header := http.Header{"Idempotency-Key": {hex.EncodeToString(key)}}
+	resp, err := c.do(ctx, "POST", "/newuser", header, body)
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		Vars []string
+	}
+	if err := json.Unmarshal(resp, &out); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+	return ParseSession(spec, out.Vars)
+}
+
+// ParseSession returns the Session described by vars, the NAME=VALUE
+// variables returned in response to the NewUser request spec
+func ParseSession(spec NewUser, vars []string) (*Session, error) {
+	res := &Session{
+		Repos: make(map[string]string),
+		Env:   make(map[string]string),
+	}
+	for _, v := range vars {
+		i := strings.Index(v, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid variable in response: %q", v)
+		}
+		res.Env[v[:i]] = v[i+1:]
+	}
+	res.Username = res.Env["GITEA_USERNAME"]
+	res.PrivateKey = res.Env["GITEA_PRIV_KEY"]
+	res.PublicKey = res.Env["GITEA_PUB_KEY"]
+	res.KeyScan = res.Env["GITEA_KEYSCAN"]
+	for _, r := range spec.Repos {
+		if p, ok := res.Env[r.Var]; ok {
+			res.Repos[r.Var] = p
+		}
+	}
+	if res.Username == "" {
+		return nil, fmt.Errorf("response did not include GITEA_USERNAME")
+	}
+	return res, nil
+}
+
+// VersionJSON returns the version document of the server, as used by
+// preguide to determine whether the output of a guide is stale
+func (c *Client) VersionJSON(ctx context.Context) ([]byte, error) {
+	return c.do(ctx, "GET", "/?get-version=1", nil, nil)
+}
+
+// BuildInfo returns the build information of the server binary, from its
+// version document
+func (c *Client) BuildInfo(ctx context.Context) (*debug.BuildInfo, error) {
+	b, err := c.VersionJSON(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := new(debug.BuildInfo)
+	if err := json.Unmarshal(b, res); err != nil {
+		return nil, fmt.Errorf("failed to decode version: %v", err)
+	}
+	return res, nil
+}
+
+// do makes a request with the given header, which may be nil, retrying as
+// configured, and returns the body of the successful response
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body []byte) ([]byte, error) {
+	delay := c.retryDelay
+	for attempt := 0; ; attempt++ {
+		res, err := c.attempt(ctx, method, path, header, body)
+		if err == nil {
+			return res, nil
+		}
+		if e, ok := err.(*Error); ok && !e.temporary() {
+			return nil, err
+		}
+		if ctx.Err() != nil || attempt == c.retries {
+			return nil, err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, header http.Header, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	var rb io.Reader
+	if body != nil {
+		rb = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, rb)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	res, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, &Error{
+			StatusCode: resp.StatusCode,
+			Message:    errorMessage(resp.Header.Get("Content-Type"), res),
+			RequestID:  resp.Header.Get("X-Request-ID"),
+		}
+	}
+	return res, nil
+}
+
+// errorMessage extracts the message from the body of an error response, which
+// is either plain text or a JSON object with an Error or Message field
+func errorMessage(contentType string, body []byte) string {
+	if strings.HasPrefix(contentType, "application/json") {
+		var v struct {
+			Error   string
+			Message string
+		}
+		if err := json.Unmarshal(body, &v); err == nil {
+			if v.Error != "" {
+				return v.Error
+			}
+			if v.Message != "" {
+				return v.Message
+			}
+		}
+	}
+	return strings.TrimSpace(string(body))
+}
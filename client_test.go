@@ -0,0 +1,87 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package gitea
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientNewUser(t *testing.T) {
+	var calls int32
+	var mu sync.Mutex
+	var keys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		keys = append(keys, req.Header.Get("Idempotency-Key"))
+		mu.Unlock()
+		// The server is unavailable on the first attempt
+		if atomic.AddInt32(&calls, 1) == 1 {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var spec NewUser
+		if err := json.NewDecoder(req.Body).Decode(&spec); err != nil || len(spec.Repos) != 1 {
+			t.Errorf("unexpected request: %v, %+v", err, spec)
+		}
+		fmt.Fprintf(resp, `{"Vars": ["GITEA_USERNAME=u1", "GITEA_PRIV_KEY=priv", "GITEA_PUB_KEY=pub", "GITEA_KEYSCAN=scan", "%v=gopher.live/u1/mod1", "GOFLAGS=-mod=mod"]}`, spec.Repos[0].Var)
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, WithRetries(1, time.Millisecond))
+	sess, err := c.NewUser(context.Background(), NewUser{
+		Repos: []Repo{{Var: "REPO1", Pattern: "mod1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.Username != "u1" || sess.PrivateKey != "priv" || sess.PublicKey != "pub" || sess.KeyScan != "scan" {
+		t.Errorf("unexpected session: %+v", sess)
+	}
+	if got := sess.Repos["REPO1"]; got != "gopher.live/u1/mod1" {
+		t.Errorf("got REPO1 %q", got)
+	}
+	if got := sess.Env["GOFLAGS"]; got != "-mod=mod" {
+		t.Errorf("got GOFLAGS %q", got)
+	}
+	// The retry is identified as a repeat of the first attempt
+	mu.Lock()
+	defer mu.Unlock()
+	if len(keys) != 2 || keys[0] == "" || keys[0] != keys[1] {
+		t.Errorf("got idempotency keys %q; want the same key for both attempts", keys)
+	}
+}
+
+func TestClientError(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		resp.Header().Set("X-Request-ID", "abc")
+		resp.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(resp, "failed to create user: boom")
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, WithRetries(3, time.Millisecond))
+	_, err := c.NewUser(context.Background(), NewUser{})
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("got error %v (%T); want *Error", err, err)
+	}
+	if e.StatusCode != http.StatusInternalServerError || e.Message != "failed to create user: boom" || e.RequestID != "abc" {
+		t.Errorf("unexpected error: %+v", e)
+	}
+	// Internal server errors are not retried
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("got %d calls; want 1", n)
+	}
+}
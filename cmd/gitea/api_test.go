@@ -0,0 +1,370 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/play-with-go/gitea"
+	"github.com/play-with-go/preguide"
+)
+
+// contractRequest is the request used by the API contract tests
+var contractRequest = gitea.NewUser{
+	Repos: []gitea.Repo{
+		{Var: "REPO1", Pattern: "mod1"},
+		{Var: "REPO2", Pattern: "mod*-two"},
+	},
+	GoEnv: &gitea.GoEnv{
+		KeyPath:        "/home/gopher/.ssh/id_ed25519",
+		KnownHostsPath: "/home/gopher/.ssh/known_hosts",
+		Flags:          "-mod=mod",
+	},
+}
+
+// postContract makes the contract request, or body if non-nil, to path on a
+// server backed by a fake Gitea instance
+func postContract(t *testing.T, path string, body []byte) (*http.Response, []byte) {
+	if body == nil {
+		var err error
+		body, err = json.Marshal(contractRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return postNewUser(t, nil, path, body)
+}
+
+// postNewUser makes a request with body to path on a server backed by a fake
+// Gitea instance. If non-nil, setup configures the server before it starts.
+func postNewUser(t *testing.T, setup func(sc *serveCmd), path string, body []byte) (*http.Response, []byte) {
+	fake := httptest.NewServer(newFakeGitea(t))
+	defer fake.Close()
+	sc := newTestServeCmd(t, fake.URL)
+	if setup != nil {
+		setup(sc)
+	}
+	srv := httptest.NewServer(newTestServer(t, newTestProvisioner(sc)).handler())
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	return resp, buf.Bytes()
+}
+
+// TestAPIV1 pins the behaviour of /v1/newuser, and its legacy alias
+// /newuser, on which existing guides depend. It must not be changed other
+// than to fix bugs, or to cover new optional fields of gitea.NewUser.
+func TestAPIV1(t *testing.T) {
+	for _, path := range []string{"/v1/newuser", "/newuser"} {
+		t.Run(path, func(t *testing.T) {
+			resp, body := postContract(t, path, nil)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %v: %s", resp.StatusCode, body)
+			}
+			var res preguide.PrestepOut
+			dec := json.NewDecoder(bytes.NewReader(body))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			vars := make(map[string]string)
+			for _, v := range res.Vars {
+				i := strings.Index(v, "=")
+				if i == -1 {
+					t.Fatalf("invalid variable %q", v)
+				}
+				names = append(names, v[:i])
+				vars[v[:i]] = v[i+1:]
+			}
+			want := []string{
+				"GITEA_USERNAME",
+				"GITEA_PRIV_KEY",
+				"GITEA_PUB_KEY",
+				"GITEA_KEYSCAN",
+				"REPO1",
+				"REPO2",
+				"GOPRIVATE",
+				"GONOPROXY",
+				"GONOSUMDB",
+				"GOFLAGS",
+				"GIT_SSH_COMMAND",
+				"GIT_CONFIG_COUNT",
+				"GIT_CONFIG_KEY_0",
+				"GIT_CONFIG_VALUE_0",
+			}
+			if !reflect.DeepEqual(names, want) {
+				t.Errorf("got vars %q; want %q", names, want)
+			}
+			user := vars["GITEA_USERNAME"]
+			if !strings.HasPrefix(vars["REPO1"], "gopher.live/"+user+"/mod1") {
+				t.Errorf("got REPO1=%v", vars["REPO1"])
+			}
+			if !strings.HasSuffix(vars["REPO2"], "-two") {
+				t.Errorf("got REPO2=%v", vars["REPO2"])
+			}
+			if got := vars["GITEA_KEYSCAN"]; got != testKeyScan {
+				t.Errorf("got GITEA_KEYSCAN=%v", got)
+			}
+
+			// Errors are plain text
+			resp, body = postContract(t, path, []byte("{"))
+			if resp.StatusCode != http.StatusBadRequest || !strings.HasPrefix(string(body), "failed to decode request: ") {
+				t.Errorf("got status %v, body %q for invalid request", resp.StatusCode, body)
+			}
+
+			// Fields added to gitea.NewUser after /v1 are accepted, with
+			// the same encoding
+			req, err := json.Marshal(gitea.NewUser{
+				UsernamePattern: "workshop-*",
+				Guide:           "hello",
+				Repos:           []gitea.Repo{{Var: "REPO1", Pattern: "{guide}-{user}"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, body = postNewUser(t, func(sc *serveCmd) {
+				if err := sc.fs.Set("usernamePrefixes", "workshop-"); err != nil {
+					t.Fatal(err)
+				}
+			}, path, req)
+			res = preguide.PrestepOut{}
+			if err := json.Unmarshal(body, &res); err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %v, %v: %s", resp.StatusCode, err, body)
+			}
+			sess, err := gitea.ParseSession(gitea.NewUser{Repos: []gitea.Repo{{Var: "REPO1"}}}, res.Vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(sess.Username, "workshop-") || sess.Repos["REPO1"] != "gopher.live/"+sess.Username+"/hello-"+sess.Username {
+				t.Errorf("got username %v, repos %v", sess.Username, sess.Repos)
+			}
+		})
+	}
+}
+
+// TestAPIV2 verifies the behaviour of /v2/newuser
+func TestAPIV2(t *testing.T) {
+	resp, body := postContract(t, "/v2/newuser", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v: %s", resp.StatusCode, body)
+	}
+	var sess gitea.Session
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&sess); err != nil {
+		t.Fatal(err)
+	}
+	if sess.Username == "" || sess.PrivateKey == "" || sess.PublicKey == "" || sess.KeyScan != testKeyScan {
+		t.Errorf("unexpected session: %+v", sess)
+	}
+	if len(sess.Repos) != 2 || !strings.HasPrefix(sess.Repos["REPO1"], "gopher.live/"+sess.Username+"/mod1") {
+		t.Errorf("got repos %v", sess.Repos)
+	}
+	if got := sess.Env["GOFLAGS"]; got != "-mod=mod" {
+		t.Errorf("got GOFLAGS %q", got)
+	}
+
+	// Errors are JSON, and can be decoded by the client
+	resp, body = postContract(t, "/v2/newuser", []byte("{"))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got status %v for invalid request", resp.StatusCode)
+	}
+	var e apiError
+	if err := json.Unmarshal(body, &e); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(e.Error, "failed to decode request: ") || e.RequestID == "" || e.RequestID != resp.Header.Get(headerRequestID) {
+		t.Errorf("unexpected error: %+v", e)
+	}
+}
+
+func TestUsernamePattern(t *testing.T) {
+	allow := func(sc *serveCmd) {
+		if err := sc.fs.Set("usernamePrefixes", "gophercon-, workshop"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		setup   func(sc *serveCmd)
+		pattern string
+		want    string // regexp the username must match; empty if rejected
+	}{
+		{nil, "", `^u[0-9a-z]{12}$`},
+		{nil, "gophercon-*", ""},
+		{allow, "gophercon-*", `^gophercon-[0-9a-z]{12}$`},
+		{allow, "gophercon-*-2024", `^gophercon-[0-9a-z]{12}-2024$`},
+		{allow, "workshop", `^workshop[0-9a-z]{12}$`},
+		{allow, "evil-*", ""},
+		{allow, "gophercon--*", ""},
+		{allow, "gophercon-*-", ""},
+		{allow, "gophercon-*!", ""},
+		{allow, "gophercon-" + strings.Repeat("x", 20) + "-*", ""},
+	} {
+		body, err := json.Marshal(gitea.NewUser{UsernamePattern: tc.pattern})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, out := postNewUser(t, tc.setup, "/v2/newuser", body)
+		if tc.want == "" {
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("%q: got status %v; want %v", tc.pattern, resp.StatusCode, http.StatusBadRequest)
+			}
+			continue
+		}
+		var sess gitea.Session
+		if err := json.Unmarshal(out, &sess); err != nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("%q: got status %v, %v: %s", tc.pattern, resp.StatusCode, err, out)
+			continue
+		}
+		if !regexp.MustCompile(tc.want).MatchString(sess.Username) {
+			t.Errorf("%q: got username %q; want match for %v", tc.pattern, sess.Username, tc.want)
+		}
+	}
+}
+
+// TestRepoPatterns verifies that repositories named with placeholders can
+// refer to the user and to preceding repositories
+func TestRepoPatterns(t *testing.T) {
+	body, err := json.Marshal(gitea.NewUser{
+		Repos: []gitea.Repo{
+			{Var: "REPO1", Pattern: "{user}-hello-{id}"},
+			{Var: "REPO2", Pattern: "{var:REPO1}-test"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, out := postNewUser(t, nil, "/v2/newuser", body)
+	var sess gitea.Session
+	if err := json.Unmarshal(out, &sess); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v, %v: %s", resp.StatusCode, err, out)
+	}
+	prefix := "gopher.live/" + sess.Username + "/"
+	repo1 := strings.TrimPrefix(sess.Repos["REPO1"], prefix)
+	if !regexp.MustCompile(`^` + sess.Username + `-hello-[0-9a-z]{12}$`).MatchString(repo1) {
+		t.Errorf("got REPO1 %q", sess.Repos["REPO1"])
+	}
+	if want := prefix + repo1 + "-test"; sess.Repos["REPO2"] != want {
+		t.Errorf("got REPO2 %q; want %q", sess.Repos["REPO2"], want)
+	}
+
+	body = []byte(`{"Repos": [{"Var": "REPO1", "Pattern": "{nope}"}]}`)
+	if resp, out := postNewUser(t, nil, "/v2/newuser", body); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %v for unknown placeholder: %s", resp.StatusCode, out)
+	}
+}
+
+// TestRepoProtections verifies that requests for protection rules that
+// cannot be applied are rejected before any user is created
+func TestRepoProtections(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		repo   gitea.Repo
+		status int
+	}{
+		{"Branch", gitea.Repo{Pattern: "mod", AutoInit: true, BranchProtections: []gitea.BranchProtection{{Branch: "main"}}}, http.StatusOK},
+		{"BranchNoAutoInit", gitea.Repo{Pattern: "mod", BranchProtections: []gitea.BranchProtection{{Branch: "main"}}}, http.StatusBadRequest},
+		{"Tags", gitea.Repo{Pattern: "mod", ProtectedTags: []gitea.ProtectedTag{{NamePattern: "v*"}}}, http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := json.Marshal(gitea.NewUser{Repos: []gitea.Repo{tc.repo}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp, out := postNewUser(t, nil, "/v2/newuser", body); resp.StatusCode != tc.status {
+				t.Errorf("got status %v; want %v: %s", resp.StatusCode, tc.status, out)
+			}
+		})
+	}
+}
+
+// TestVersion verifies that the version document changes with the Gitea
+// version, the keyscan and the configuration
+func TestVersion(t *testing.T) {
+	get := func(p *provisioner) versionDoc {
+		srv := httptest.NewServer(newTestServer(t, p).handler())
+		defer srv.Close()
+		resp, err := http.Get(srv.URL + "/v1/version")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %v", resp.StatusCode)
+		}
+		var v versionDoc
+		if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	base := get(newTestProvisioner(newTestServeCmd(t, "http://gopher.live")))
+	if base.BuildInfo == nil || base.GoVersion == "" {
+		t.Errorf("version document does not include build info: %+v", base)
+	}
+	if base.GiteaVersion != "1.15.9" {
+		t.Errorf("got GiteaVersion %q", base.GiteaVersion)
+	}
+	if want := "SHA256:g4Z8X5WFMxuum0H4C9hmzbt3tsg/A+xr/YT5hMJS/NU"; base.KeyScan != want {
+		t.Errorf("got KeyScan %q; want %q", base.KeyScan, want)
+	}
+
+	sc := newTestServeCmd(t, "http://gopher.live")
+	if v := get(sc.newProvisioner("1.16.0", testKeyScan)); v.GiteaVersion == base.GiteaVersion {
+		t.Errorf("GiteaVersion did not change")
+	}
+	sc = newTestServeCmd(t, "http://gopher.live")
+	hashed := "|1|c2FsdA==|aGFzaA== " + strings.SplitN(testKeyScan, " ", 2)[1]
+	if v := get(sc.newProvisioner("1.15.9", hashed)); v.KeyScan != base.KeyScan {
+		t.Errorf("KeyScan changed with the hashing of hostnames: %q", v.KeyScan)
+	}
+	for name, value := range map[string]string{
+		// Settings that affect /newuser responses
+		"rootURL":          "https://example.com",
+		"idFormat":         "words",
+		"idPrefix":         "x",
+		"idLength":         "16",
+		"idAlphabet":       "0123456789",
+		"usernamePrefixes": "workshop-",
+
+		// Operational settings
+		"debug":             "true",
+		"logFormat":         "json",
+		"port":              "9090",
+		"shutdownTimeout":   "1h",
+		"sessionTTL":        "1h",
+		"idempotencyWindow": "1m",
+	} {
+		sc := newTestServeCmd(t, "http://gopher.live")
+		f := sc.fs.Lookup(name)
+		if f == nil {
+			f = sc.rootCmd.fs.Lookup(name)
+		}
+		if err := f.Value.Set(value); err != nil {
+			t.Fatal(err)
+		}
+		changed := get(newTestProvisioner(sc)).Config != base.Config
+		if want := slices.Contains(configFlags, name); changed != want {
+			t.Errorf("setting -%v changed Config: %v; want %v", name, changed, want)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// The events recorded in the audit log
+const (
+	auditUserCreated  = "user.created"
+	auditKeyUploaded  = "key.uploaded"
+	auditRepoCreated  = "repo.created"
+	auditUserReleased = "user.released"
+	auditUserReaped   = "user.reaped"
+)
+
+// auditEvent is a record in the audit log, written as a single line of JSON.
+// It never holds secrets: keys are identified by their fingerprint.
+type auditEvent struct {
+	Time      time.Time
+	Event     string
+	Command   string
+	User      string
+	Repo      string `json:",omitempty"`
+	Key       string `json:",omitempty"` // SHA256 fingerprint
+	Reason    string `json:",omitempty"`
+	RequestID string `json:",omitempty"`
+	Caller    string `json:",omitempty"`
+}
+
+// auditLog is an append-only sink for audit events. A nil *auditLog discards
+// events, which is the case when -auditLog is not set.
+type auditLog struct {
+	command string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// openAuditLog returns the audit log for command (serve or reap) that writes
+// to the file path, or to stdout if path is "-". If path is empty, auditing
+// is disabled and a nil *auditLog is returned.
+func openAuditLog(path, command string) (*auditLog, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		return &auditLog{command: command, w: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{command: command, w: f}, nil
+}
+
+// record writes ev to the audit log, filling in the time, the command, and
+// the request ID and caller carried by ctx (see withAuditContext). Failure to
+// write is logged rather than failing the operation being audited.
+func (a *auditLog) record(ctx context.Context, ev auditEvent) {
+	if a == nil {
+		return
+	}
+	ev.Time = time.Now().UTC()
+	ev.Command = a.command
+	ac := auditContextOf(ctx)
+	ev.RequestID = ac.requestID
+	ev.Caller = ac.caller
+	b, err := json.Marshal(ev)
+	if err != nil {
+		logger(ctx).Error("failed to marshal audit event", "err", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(b, '\n')); err != nil {
+		logger(ctx).Error("failed to write audit event", "event", ev.Event, "err", err)
+	}
+}
+
+type auditKey struct{}
+
+type auditContext struct {
+	requestID string
+	caller    string
+}
+
+// withAuditContext returns a copy of ctx that carries the request ID and
+// caller identity recorded against audit events
+func withAuditContext(ctx context.Context, requestID, caller string) context.Context {
+	return context.WithValue(ctx, auditKey{}, auditContext{
+		requestID: requestID,
+		caller:    caller,
+	})
+}
+
+// auditContextOf returns the request ID and caller carried by ctx, if any
+func auditContextOf(ctx context.Context) auditContext {
+	ac, _ := ctx.Value(auditKey{}).(auditContext)
+	return ac
+}
+
+// requestCaller returns the identity of the caller that made req: the common
+// name of its client certificate with mutual TLS, else its remote address
+func requestCaller(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		return "cn=" + req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+func (ac *auditCmd) run(args []string) error {
+	if err := ac.fs.Parse(args); err != nil {
+		return ac.usageErr("failed to parse flags: %v", err)
+	}
+	if err := ac.config.applyFlags(ac.fs, "audit"); err != nil {
+		return ac.usageErr("%v", err)
+	}
+	now := time.Now()
+	since, err := parseAuditTime(*ac.fSince, now)
+	if err != nil {
+		return ac.usageErr("invalid -since: %v", err)
+	}
+	until, err := parseAuditTime(*ac.fUntil, now)
+	if err != nil {
+		return ac.usageErr("invalid -until: %v", err)
+	}
+	if _, err := path.Match(*ac.fUser, ""); err != nil {
+		return ac.usageErr("invalid -user pattern: %v", err)
+	}
+
+	files := ac.fs.Args()
+	if len(files) == 0 {
+		if *ac.fAuditLog == "" || *ac.fAuditLog == "-" {
+			return ac.usageErr("no audit log file specified, and -auditLog is not a file")
+		}
+		files = []string{*ac.fAuditLog}
+	}
+
+	filter := auditFilter{
+		user:  *ac.fUser,
+		event: *ac.fEvent,
+		since: since,
+		until: until,
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for _, fn := range files {
+		if err := ac.query(out, fn, filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditFilter selects audit events by user (a path.Match pattern), event,
+// and time: since is inclusive and until exclusive. Empty and zero fields
+// match all events.
+type auditFilter struct {
+	user  string
+	event string
+	since time.Time
+	until time.Time
+}
+
+func (f auditFilter) match(ev auditEvent) bool {
+	if f.user != "" {
+		if ok, _ := path.Match(f.user, ev.User); !ok {
+			return false
+		}
+	}
+	if f.event != "" && ev.Event != f.event {
+		return false
+	}
+	if !f.since.IsZero() && ev.Time.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !ev.Time.Before(f.until) {
+		return false
+	}
+	return true
+}
+
+// query writes to w the events in the audit log file fn that match filter.
+// Lines that cannot be decoded, for example a last line that was only
+// partially written before a crash, are skipped with a warning.
+func (ac *auditCmd) query(w io.Writer, fn string, filter auditFilter) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		var ev auditEvent
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			ac.logger.Warn("skipping malformed audit event", "file", fn, "line", line, "err", err)
+			continue
+		}
+		if filter.match(ev) {
+			w.Write(sc.Bytes())
+			io.WriteString(w, "\n")
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("failed to read %v: %v", fn, err)
+	}
+	return nil
+}
+
+// parseAuditTime parses s as either an RFC 3339 time, or a duration that is
+// interpreted as that long before now. The empty string gives the zero time.
+func parseAuditTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor a duration", s)
+	}
+	return now.Add(-d), nil
+}
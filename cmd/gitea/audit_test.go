@@ -0,0 +1,115 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAuditTime(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		in   string
+		want time.Time
+	}{
+		{"", time.Time{}},
+		{"2020-05-31T10:30:00Z", time.Date(2020, 5, 31, 10, 30, 0, 0, time.UTC)},
+		{"2020-05-31T12:30:00+02:00", time.Date(2020, 5, 31, 10, 30, 0, 0, time.UTC)},
+		{"90m", now.Add(-90 * time.Minute)},
+		{"24h", now.Add(-24 * time.Hour)},
+	} {
+		got, err := parseAuditTime(tc.in, now)
+		if err != nil {
+			t.Errorf("parseAuditTime(%q): %v", tc.in, err)
+			continue
+		}
+		if !got.Equal(tc.want) {
+			t.Errorf("parseAuditTime(%q) = %v; want %v", tc.in, got, tc.want)
+		}
+	}
+	for _, in := range []string{"yesterday", "2020-05-31", "10"} {
+		if got, err := parseAuditTime(in, now); err == nil {
+			t.Errorf("parseAuditTime(%q) = %v; want error", in, got)
+		}
+	}
+}
+
+// TestAuditQuery verifies the filtering of audit events, and that malformed
+// lines, such as a partially written last line, are skipped
+func TestAuditQuery(t *testing.T) {
+	t0 := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	events := []auditEvent{
+		{Time: t0, Event: auditUserCreated, User: "u1234"},
+		{Time: t0.Add(time.Minute), Event: auditRepoCreated, User: "u1234", Repo: "x"},
+		{Time: t0.Add(2 * time.Minute), Event: auditUserCreated, User: "u5678"},
+		{Time: t0.Add(3 * time.Minute), Event: auditUserReaped, User: "u1234"},
+	}
+	var log bytes.Buffer
+	for i, ev := range events {
+		b, err := json.Marshal(ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log.Write(b)
+		log.WriteString("\n")
+		if i == 1 {
+			log.WriteString("not json\n")
+		}
+	}
+	log.WriteString(`{"Time":"2020-06-01T12:04:00Z","Event":"user.crea`)
+	fn := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(fn, log.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings bytes.Buffer
+	r := &runner{rootCmd: &rootCmd{logger: slog.New(slog.NewTextHandler(&warnings, nil))}}
+	ac := newAuditCmd(r)
+	for _, tc := range []struct {
+		name   string
+		filter auditFilter
+		want   []int
+	}{
+		{"All", auditFilter{}, []int{0, 1, 2, 3}},
+		{"User", auditFilter{user: "u1234"}, []int{0, 1, 3}},
+		{"UserPattern", auditFilter{user: "u5*"}, []int{2}},
+		{"Event", auditFilter{event: auditUserCreated}, []int{0, 2}},
+		{"Since", auditFilter{since: t0.Add(time.Minute)}, []int{1, 2, 3}},
+		{"Until", auditFilter{until: t0.Add(2 * time.Minute)}, []int{0, 1}},
+		{"Combined", auditFilter{user: "u1234", event: auditUserCreated, since: t0, until: t0.Add(time.Hour)}, []int{0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			warnings.Reset()
+			var out bytes.Buffer
+			if err := ac.query(&out, fn, tc.filter); err != nil {
+				t.Fatal(err)
+			}
+			var want bytes.Buffer
+			for _, i := range tc.want {
+				b, _ := json.Marshal(events[i])
+				want.Write(b)
+				want.WriteString("\n")
+			}
+			if out.String() != want.String() {
+				t.Errorf("got:\n%s\nwant:\n%s", out.String(), want.String())
+			}
+			if n := strings.Count(warnings.String(), "skipping malformed audit event"); n != 2 {
+				t.Errorf("got %d warnings; want 2:\n%s", n, warnings.String())
+			}
+		})
+	}
+
+	if err := ac.query(io.Discard, filepath.Join(t.TempDir(), "missing.log"), auditFilter{}); err == nil {
+		t.Errorf("query of missing file succeeded")
+	}
+}
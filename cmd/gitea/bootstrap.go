@@ -0,0 +1,178 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.gitea.io/sdk/gitea"
+)
+
+func (bc *bootstrapCmd) run(args []string) error {
+	if err := bc.fs.Parse(args); err != nil {
+		return bc.usageErr("failed to parse flags: %v", err)
+	}
+	if err := bc.config.applyFlags(bc.fs, "bootstrap"); err != nil {
+		return bc.usageErr("%v", err)
+	}
+	if len(bc.fs.Args()) > 0 {
+		return bc.usageErr("bootstrap does not take any arguments")
+	}
+	if *bc.fUsername == "" {
+		return bc.usageErr("must supply a contributor username")
+	}
+	if *bc.fEnvFile == "" {
+		return bc.usageErr("must supply an env file")
+	}
+	var fixtures [][2]string
+	for _, f := range splitList(*bc.fRepos) {
+		parts := strings.Split(f, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return bc.usageErr("invalid fixture repository %q: must be owner/name", f)
+		}
+		fixtures = append(fixtures, [2]string{parts[0], parts[1]})
+	}
+	email := *bc.fEmail
+	if email == "" {
+		email = fmt.Sprintf("%v@%v", *bc.fUsername, bc.hostname)
+	}
+
+	// Requires real root credentials
+	client, err := bc.newGiteaClient(bc.rootCredentials())
+	check(err, "failed to create root client: %v", err)
+
+	user := bc.ensureContributor(client, *bc.fUsername, email, *bc.fFullName)
+
+	// Reuse the token in the env file from a previous run if it still works,
+	// else issue a new one
+	var token string
+	if prev, err := readEnvFile(*bc.fEnvFile); err == nil {
+		if prev[EnvContributorUser] == user.UserName && bc.validToken(user.UserName, prev[EnvContributorPassword]) {
+			token = prev[EnvContributorPassword]
+			bc.logger.Info("reusing existing token", "user", user.UserName)
+		}
+	}
+	if token == "" {
+		t := bc.issueToken(user.UserName, *bc.fTokenName)
+		token = t.Token
+	}
+
+	for _, org := range splitList(*bc.fOrgs) {
+		_, resp, err := client.GetOrg(org)
+		if err == nil {
+			bc.logger.Info("organisation exists", "org", org)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusNotFound {
+			raise("failed to get organisation %v: %v", org, err)
+		}
+		_, _, err = client.AdminCreateOrg(user.UserName, gitea.CreateOrgOption{
+			Name:       org,
+			Visibility: gitea.VisibleTypePublic,
+		})
+		check(err, "failed to create organisation %v: %v", org, err)
+		bc.logger.Info("created organisation", "org", org)
+	}
+
+	for _, f := range fixtures {
+		owner, name := f[0], f[1]
+		_, resp, err := client.GetRepo(owner, name)
+		if err == nil {
+			bc.logger.Info("repository exists", "owner", owner, "repo", name)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusNotFound {
+			raise("failed to get repository %v/%v: %v", owner, name, err)
+		}
+		_, _, err = client.AdminCreateRepo(owner, gitea.CreateRepoOption{
+			Name:          name,
+			AutoInit:      true,
+			Readme:        "Default",
+			DefaultBranch: "main",
+		})
+		check(err, "failed to create repository %v/%v: %v", owner, name, err)
+		bc.logger.Info("created repository", "owner", owner, "repo", name)
+	}
+
+	env := [][2]string{
+		{EnvContributorUser, user.UserName},
+		{EnvContributorPassword, token},
+		{"GITEA_ROOT_URL", *bc.fRootURL},
+	}
+	err = writeEnvFile(*bc.fEnvFile, env)
+	check(err, "failed to write env file: %v", err)
+	return nil
+}
+
+// readEnvFile reads the KEY=VALUE lines of the env file path
+func readEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.Index(line, "="); i > 0 {
+			res[line[:i]] = line[i+1:]
+		}
+	}
+	return res, sc.Err()
+}
+
+// writeEnvFile writes vars as KEY=VALUE lines to the file path, or to stdout
+// if path is "-" (see writeOutput)
+func writeEnvFile(path string, vars [][2]string) error {
+	var buf bytes.Buffer
+	for _, v := range vars {
+		fmt.Fprintf(&buf, "%v=%v\n", v[0], v[1])
+	}
+	return writeOutput(path, buf.Bytes())
+}
+
+// writeOutput writes b to the file path, or to stdout if path is "-". The
+// file is only readable by its owner, since it typically holds credentials,
+// and is replaced atomically.
+func writeOutput(path string, b []byte) error {
+	if path == "-" {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".gitea-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// splitList splits the comma-separated list s, dropping empty elements
+func splitList(s string) []string {
+	var res []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			res = append(res, e)
+		}
+	}
+	return res
+}
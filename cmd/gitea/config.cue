@@ -0,0 +1,196 @@
+package gitea
+
+import "time"
+
+// #Config is the schema of the file passed to gitea via -config. Every field
+// is optional: a setting takes its value from, in order of precedence, its
+// flag, its environment variable, this file, and finally its default.
+//
+// The environment variable for a flag is GITEA_ followed by the command name
+// (if any) and the flag name, in upper snake case. For example -rootURL is
+// GITEA_ROOT_URL and serve's -shutdownTimeout is
+// GITEA_SERVE_SHUTDOWN_TIMEOUT.
+#Config: {
+	// rootURL is the root URL of the Gitea instance (-rootURL)
+	rootURL?: string
+
+	// debug enables debug output (-debug)
+	debug?: bool
+
+	// logFormat is the format of log output, text or json (-logFormat)
+	logFormat?: "text" | "json"
+
+	// debugHTTPFile is the file to which Gitea API traffic is dumped with
+	// debug (-debugHTTPFile)
+	debugHTTPFile?: string
+
+	// auditLog is the file to which serve and reap append audit events, or
+	// - for stdout (-auditLog)
+	auditLog?: string
+
+	// root holds the credentials of the Gitea admin user, used by reap,
+	// newcontributor and loadtest. Overridden by PLAYWITHGODEV_ROOT_USER and
+	// PLAYWITHGODEV_ROOT_PASSWORD
+	root?: #Credentials
+
+	// contributor holds the credentials of the contributor account used by
+	// serve. Overridden by PLAYWITHGODEV_CONTRIBUTOR_USER and
+	// PLAYWITHGODEV_CONTRIBUTOR_PASSWORD
+	contributor?: #Credentials
+
+	serve?: {
+		// port is the port on which to listen (-port)
+		port?: string | int
+
+		// shutdownTimeout is the time allowed for in-flight requests to
+		// complete on shutdown (-shutdownTimeout)
+		shutdownTimeout?: time.Duration
+
+		// tlsCert and tlsKey are the TLS certificate and key files
+		// (-tlsCert, -tlsKey)
+		tlsCert?: string
+		tlsKey?:  string
+
+		// tlsClientCA is the CA certificates file used to verify client
+		// certificates (-tlsClientCA)
+		tlsClientCA?: string
+
+		// otlpEndpoint is the OTLP/HTTP endpoint URL to which traces are
+		// exported (-otlpEndpoint)
+		otlpEndpoint?: string
+
+		// stateFile is the file in which sessions are persisted
+		// (-stateFile)
+		stateFile?: string
+
+		// sessionTTL is the time after which a session expires
+		// (-sessionTTL)
+		sessionTTL?: time.Duration
+
+		// idFormat is the format of the IDs in the names of users and
+		// repositories (-idFormat)
+		idFormat?: "counter" | "words"
+
+		// idPrefix is the prefix of the usernames of temporary users
+		// (-idPrefix)
+		idPrefix?: string
+
+		// idLength and idAlphabet are the length and alphabet of counter
+		// IDs (-idLength, -idAlphabet)
+		idLength?:   int
+		idAlphabet?: string
+
+		// usernamePrefixes is a comma-separated list of the prefixes with
+		// which the UsernamePattern of a request must begin
+		// (-usernamePrefixes)
+		usernamePrefixes?: string
+
+		// idempotencyWindow is the time for which the response to a
+		// /newuser request with an Idempotency-Key header is replayed
+		// (-idempotencyWindow)
+		idempotencyWindow?: time.Duration
+	}
+
+	reap?: {
+		// age is the age beyond which users and repositories are reaped
+		// (-age)
+		age?: time.Duration
+	}
+
+	audit?: {
+		// user is a pattern that the usernames of shown events must match
+		// (-user)
+		user?: string
+
+		// event is the type of the shown events (-event)
+		event?: string
+
+		// since and until bound the time of shown events, as RFC 3339
+		// times or durations ago (-since, -until)
+		since?: string
+		until?: string
+	}
+
+	list?: {
+		// format is the output format, table or json (-format)
+		format?: "table" | "json"
+
+		// user is a pattern that listed usernames must match (-user)
+		user?: string
+
+		// minAge and maxAge bound the age of listed users (-minAge,
+		// -maxAge)
+		minAge?: time.Duration
+		maxAge?: time.Duration
+	}
+
+	bootstrap?: {
+		username?:  string
+		email?:     string
+		fullname?:  string
+		tokenName?: string
+
+		// orgs and repos are comma-separated lists of the shared
+		// organisations and owner/name fixture repositories to create
+		// (-orgs, -repos)
+		orgs?:  string
+		repos?: string
+
+		// envFile is the file to which the contributor credentials are
+		// written (-envFile)
+		envFile?: string
+	}
+
+	newcontributor?: {
+		email?:    string
+		fullname?: string
+		username?: string
+		format?:   "json" | "env"
+	}
+
+	loadtest?: {
+		// url is the base URL of the serve instance under test (-url)
+		url?: string
+
+		// spec is the file containing the gitea.NewUser request (-spec)
+		spec?: string
+
+		// requests and duration limit the number of requests made and
+		// the time for which they are started (-requests, -duration)
+		requests?: int
+		duration?: time.Duration
+
+		// rate is the number of requests started per second, and
+		// concurrency the maximum number in flight (-rate, -concurrency)
+		rate?:        number
+		concurrency?: int
+
+		// timeout is the time allowed for each request (-timeout)
+		timeout?: time.Duration
+
+		// cleanup is what to remove afterwards (-cleanup)
+		cleanup?: "none" | "release" | "reap"
+
+		// format is the report format (-format)
+		format?: "text" | "json"
+
+		// usernamePattern is the UsernamePattern of the users created
+		// (-usernamePattern)
+		usernamePattern?: string
+	}
+
+	// contributorCmd holds the settings of the contributor command, whose
+	// name is taken by the contributor credentials above. Its environment
+	// variables are nonetheless named GITEA_CONTRIBUTOR_*.
+	contributorCmd?: {
+		username?:  string
+		format?:    "json" | "env"
+		out?:       string
+		tokenName?: string
+	}
+}
+
+#Credentials: {
+	user?:     string
+	password?: string
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	_ "embed"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/cuecontext"
+	"cuelang.org/go/cue/errors"
+)
+
+//go:embed config.cue
+var configSchema []byte
+
+// config is a configuration file loaded via -config, validated against
+// #Config in config.cue. The zero value represents the absence of a
+// configuration file.
+type config struct {
+	v cue.Value
+
+	// loaded indicates whether a configuration file was loaded
+	loaded bool
+}
+
+func loadConfig(path string) (*config, error) {
+	if path == "" {
+		return new(config), nil
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	ctx := cuecontext.New()
+	schema := ctx.CompileBytes(configSchema, cue.Filename("config.cue"))
+	if err := schema.Err(); err != nil {
+		return nil, fmt.Errorf("failed to compile config schema: %v", err)
+	}
+	v := ctx.CompileBytes(src, cue.Filename(path))
+	if err := v.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load config file %v:\n%v", path, errors.Details(err, nil))
+	}
+	v = schema.LookupPath(cue.ParsePath("#Config")).Unify(v)
+	if err := v.Validate(cue.Concrete(true)); err != nil {
+		return nil, fmt.Errorf("invalid config file %v:\n%v", path, errors.Details(err, nil))
+	}
+	return &config{v: v, loaded: true}, nil
+}
+
+// lookup returns the string form of the value at path in the configuration
+// file, and whether the value was set
+func (c *config) lookup(path string) (string, bool) {
+	if !c.loaded {
+		return "", false
+	}
+	v := c.v.LookupPath(cue.ParsePath(path))
+	if !v.Exists() {
+		return "", false
+	}
+	var res interface{}
+	var err error
+	switch v.Kind() {
+	case cue.StringKind:
+		res, err = v.String()
+	case cue.BoolKind:
+		res, err = v.Bool()
+	case cue.IntKind:
+		res, err = v.Int64()
+	case cue.FloatKind:
+		res, err = v.Float64()
+	default:
+		err = fmt.Errorf("unexpected kind %v", v.Kind())
+	}
+	check(err, "failed to read %v from config file: %v", path, err)
+	return fmt.Sprint(res), true
+}
+
+// setting returns the value of a setting that has no flag: the value of env
+// if set, else the value at path in the configuration file, else the empty
+// string
+func (c *config) setting(env, path string) string {
+	if v, ok := os.LookupEnv(env); ok {
+		return v
+	}
+	v, _ := c.lookup(path)
+	return v
+}
+
+// configSections maps the commands whose section of the configuration file
+// is not named after them, because that name is taken by another field, to
+// their section
+var configSections = map[string]string{
+	// contributor holds the credentials of the contributor account
+	"contributor": "contributorCmd",
+}
+
+// applyFlags sets each flag in fs that was not set on the command line from,
+// in order of precedence, its environment variable (see flagEnv) and the
+// value at section.flag in the configuration file, where section is that of
+// the command per configSections. Root flags use an empty section.
+func (c *config) applyFlags(fs *flag.FlagSet, section string) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		path := f.Name
+		if section != "" {
+			path = section + "." + f.Name
+			if cs, ok := configSections[section]; ok {
+				path = cs + "." + f.Name
+			}
+		}
+		env := flagEnv(section, f.Name)
+		v, ok := os.LookupEnv(env)
+		from := "$" + env
+		if !ok {
+			v, ok = c.lookup(path)
+			from = "config file field " + path
+		}
+		if !ok {
+			return
+		}
+		if serr := fs.Set(f.Name, v); serr != nil {
+			err = fmt.Errorf("invalid value %q for -%v from %v: %v", v, f.Name, from, serr)
+		}
+	})
+	return err
+}
+
+// flagEnv returns the name of the environment variable corresponding to the
+// flag name of the command section. For example, the -shutdownTimeout flag of
+// serve corresponds to GITEA_SERVE_SHUTDOWN_TIMEOUT.
+func flagEnv(section, name string) string {
+	var b strings.Builder
+	b.WriteString("GITEA_")
+	if section != "" {
+		b.WriteString(strings.ToUpper(section))
+		b.WriteString("_")
+	}
+	var prev rune
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) && !unicode.IsUpper(prev) {
+			b.WriteString("_")
+		}
+		b.WriteRune(unicode.ToUpper(r))
+		prev = r
+	}
+	return b.String()
+}
+
+// rootCredentials returns the credentials of the Gitea admin user
+func (r *runner) rootCredentials() (user, password string) {
+	return r.config.setting(EnvRootUser, "root.user"), r.config.setting(EnvRootPassword, "root.password")
+}
+
+// contributorCredentials returns the credentials of the contributor account
+func (r *runner) contributorCredentials() (user, password string) {
+	return r.config.setting(EnvContributorUser, "contributor.user"), r.config.setting(EnvContributorPassword, "contributor.password")
+}
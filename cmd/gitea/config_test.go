@@ -0,0 +1,241 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes src to a configuration file and loads it
+func writeConfig(t *testing.T, src string) (*config, error) {
+	path := filepath.Join(t.TempDir(), "config.cue")
+	if err := os.WriteFile(path, []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return loadConfig(path)
+}
+
+// TestApplyFlags verifies that flags take their values from, in order of
+// precedence, the command line, the environment, the configuration file and
+// their defaults
+func TestApplyFlags(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		section string
+		flag    string
+		args    []string
+		env     map[string]string
+		file    string
+		want    string
+	}{
+		{
+			name:    "Default",
+			section: "serve",
+			flag:    "shutdownTimeout",
+			want:    "default",
+		},
+		{
+			name:    "File",
+			section: "serve",
+			flag:    "shutdownTimeout",
+			file:    `serve: shutdownTimeout: "2m"`,
+			want:    "2m",
+		},
+		{
+			name:    "Env",
+			section: "serve",
+			flag:    "shutdownTimeout",
+			env:     map[string]string{"GITEA_SERVE_SHUTDOWN_TIMEOUT": "3m"},
+			file:    `serve: shutdownTimeout: "2m"`,
+			want:    "3m",
+		},
+		{
+			name:    "Flag",
+			section: "serve",
+			flag:    "shutdownTimeout",
+			args:    []string{"-shutdownTimeout", "4m"},
+			env:     map[string]string{"GITEA_SERVE_SHUTDOWN_TIMEOUT": "3m"},
+			file:    `serve: shutdownTimeout: "2m"`,
+			want:    "4m",
+		},
+		{
+			name:    "OtherSection",
+			section: "serve",
+			flag:    "age",
+			env:     map[string]string{"GITEA_REAP_AGE": "3m"},
+			file:    `reap: age: "2m"`,
+			want:    "default",
+		},
+		{
+			name: "RootFile",
+			flag: "rootURL",
+			file: `rootURL: "https://example.com"`,
+			want: "https://example.com",
+		},
+		{
+			name: "RootEnv",
+			flag: "rootURL",
+			env:  map[string]string{"GITEA_ROOT_URL": "https://example.org"},
+			file: `rootURL: "https://example.com"`,
+			want: "https://example.org",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			c := new(config)
+			if tc.file != "" {
+				var err error
+				if c, err = writeConfig(t, tc.file); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			v := fs.String(tc.flag, "default", "")
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.applyFlags(fs, tc.section); err != nil {
+				t.Fatal(err)
+			}
+			if *v != tc.want {
+				t.Errorf("got %v; want %v", *v, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplyFlagsInvalid(t *testing.T) {
+	t.Setenv("GITEA_SERVE_SHUTDOWN_TIMEOUT", "soon")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Duration("shutdownTimeout", 0, "")
+	err := new(config).applyFlags(fs, "serve")
+	if err == nil || !strings.Contains(err.Error(), "$GITEA_SERVE_SHUTDOWN_TIMEOUT") {
+		t.Errorf("got error %v; want an error naming $GITEA_SERVE_SHUTDOWN_TIMEOUT", err)
+	}
+}
+
+func TestFlagEnv(t *testing.T) {
+	for _, tc := range []struct {
+		section, name, want string
+	}{
+		{"", "debug", "GITEA_DEBUG"},
+		{"", "rootURL", "GITEA_ROOT_URL"},
+		{"serve", "shutdownTimeout", "GITEA_SERVE_SHUTDOWN_TIMEOUT"},
+		{"serve", "tlsClientCA", "GITEA_SERVE_TLS_CLIENT_CA"},
+		{"newcontributor", "format", "GITEA_NEWCONTRIBUTOR_FORMAT"},
+	} {
+		if got := flagEnv(tc.section, tc.name); got != tc.want {
+			t.Errorf("flagEnv(%q, %q) = %v; want %v", tc.section, tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestLoadConfig verifies that a configuration file is validated against
+// the schema, and that settings without flags are read from it
+func TestLoadConfig(t *testing.T) {
+	c, err := writeConfig(t, `
+rootURL: "https://example.com"
+root: user: "admin"
+serve: {
+	port: 8443
+	idFormat: "words"
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"rootURL":        "https://example.com",
+		"serve.port":     "8443",
+		"serve.idFormat": "words",
+	} {
+		if got, ok := c.lookup(path); !ok || got != want {
+			t.Errorf("lookup(%q) = %q, %v; want %q", path, got, ok, want)
+		}
+	}
+	if got, ok := c.lookup("serve.stateFile"); ok {
+		t.Errorf("lookup of unset field returned %q", got)
+	}
+	t.Setenv(EnvRootPassword, "secret")
+	if user, password := c.setting(EnvRootUser, "root.user"), c.setting(EnvRootPassword, "root.password"); user != "admin" || password != "secret" {
+		t.Errorf("got root credentials %q, %q; want admin, secret", user, password)
+	}
+
+	for _, tc := range []struct {
+		name, src, want string
+	}{
+		{"UnknownField", `serve: nope: 1`, "field not allowed"},
+		{"WrongType", `serve: idLength: "long"`, "conflicting values"},
+		{"Disallowed", `serve: idFormat: "uuid"`, "idFormat"},
+		{"Syntax", `serve: {`, "failed to load config file"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := writeConfig(t, tc.src)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got error %v; want one containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+// TestConfigContributor verifies that the contributor credentials and the
+// settings of the contributor command can be set in the same file
+func TestConfigContributor(t *testing.T) {
+	c, err := writeConfig(t, `
+contributor: {
+	user: "contributor"
+	password: "s3cret"
+}
+contributorCmd: format: "env"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, password := c.setting(EnvContributorUser, "contributor.user"), c.setting(EnvContributorPassword, "contributor.password"); user != "contributor" || password != "s3cret" {
+		t.Errorf("got contributor credentials %q, %q; want contributor, s3cret", user, password)
+	}
+	cc := newContributorCommand(new(runner))
+	if err := c.applyFlags(cc.fs, "contributor"); err != nil {
+		t.Fatal(err)
+	}
+	if *cc.fFormat != "env" {
+		t.Errorf("got -format %v; want env", *cc.fFormat)
+	}
+	t.Setenv("GITEA_CONTRIBUTOR_OUT", "token.env")
+	if err := c.applyFlags(cc.fs, "contributor"); err != nil {
+		t.Fatal(err)
+	}
+	if *cc.fOut != "token.env" {
+		t.Errorf("got -out %v; want token.env", *cc.fOut)
+	}
+}
+
+// TestConfigAudit verifies that the settings of the audit command can be set
+// in a configuration file
+func TestConfigAudit(t *testing.T) {
+	c, err := writeConfig(t, `
+audit: {
+	user: "u*"
+	event: "user.created"
+	since: "24h"
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := newAuditCmd(new(runner))
+	if err := c.applyFlags(ac.fs, "audit"); err != nil {
+		t.Fatal(err)
+	}
+	if *ac.fUser != "u*" || *ac.fEvent != "user.created" || *ac.fSince != "24h" || *ac.fUntil != "" {
+		t.Errorf("got -user %q -event %q -since %q -until %q", *ac.fUser, *ac.fEvent, *ac.fSince, *ac.fUntil)
+	}
+}
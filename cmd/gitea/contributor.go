@@ -0,0 +1,264 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.gitea.io/sdk/gitea"
+)
+
+func (cc *contributorCmd) run(args []string) error {
+	if len(args) == 0 {
+		return cc.usageErr("missing subcommand")
+	}
+	sub := args[0]
+	if err := cc.fs.Parse(args[1:]); err != nil {
+		return cc.usageErr("failed to parse flags: %v", err)
+	}
+	if err := cc.config.applyFlags(cc.fs, "contributor"); err != nil {
+		return cc.usageErr("%v", err)
+	}
+	if len(cc.fs.Args()) > 0 {
+		return cc.usageErr("%v does not take any arguments", sub)
+	}
+	username := *cc.fUsername
+	if username == "" {
+		username, _ = cc.contributorCredentials()
+	}
+	if username == "" {
+		return cc.usageErr("must supply a contributor username")
+	}
+
+	switch sub {
+	case "rotate-token":
+		if *cc.fFormat != "json" && *cc.fFormat != "env" {
+			return cc.usageErr("unknown -format %q for rotate-token", *cc.fFormat)
+		}
+		return cc.rotateToken(username)
+	case "list-tokens":
+		if *cc.fFormat != "json" && *cc.fFormat != "env" {
+			return cc.usageErr("unknown -format %q for list-tokens", *cc.fFormat)
+		}
+		return cc.listTokens(username)
+	case "revoke":
+		if (*cc.fID != 0) == *cc.fAll {
+			return cc.usageErr("revoke requires exactly one of -id and -all")
+		}
+		return cc.revoke(username)
+	default:
+		return cc.usageErr("unknown subcommand: %v", sub)
+	}
+}
+
+// rotateToken issues a new token for username, named -tokenName with a
+// timestamp suffix, and unless -keepOld revokes the earlier tokens of that
+// name
+func (cc *contributorCmd) rotateToken(username string) error {
+	name := fmt.Sprintf("%v-%v", *cc.fTokenName, time.Now().UTC().Format("20060102T150405Z"))
+	token := cc.issueToken(username, name)
+	if !*cc.fKeepOld {
+		for _, t := range cc.tokens(username) {
+			if t.ID == token.ID || !isRotatedToken(t.Name, *cc.fTokenName) {
+				continue
+			}
+			cc.deleteToken(username, t)
+		}
+	}
+	return cc.writeCredentials(username, token)
+}
+
+// isRotatedToken reports whether name is that of a token created by
+// rotate-token with the given -tokenName, or that token name itself
+func isRotatedToken(name, tokenName string) bool {
+	return name == tokenName || strings.HasPrefix(name, tokenName+"-")
+}
+
+// listTokens prints the tokens of username. The token values themselves are
+// never available after creation: only their last eight characters are
+// listed.
+func (cc *contributorCmd) listTokens(username string) error {
+	tokens := cc.tokens(username)
+	if *cc.fFormat == "json" {
+		type listedToken struct {
+			ID             int64
+			Name           string
+			TokenLastEight string
+		}
+		res := []listedToken{}
+		for _, t := range tokens {
+			res = append(res, listedToken{ID: t.ID, Name: t.Name, TokenLastEight: t.TokenLastEight})
+		}
+		b, err := json.MarshalIndent(res, "", "  ")
+		check(err, "failed to JSON-marshal tokens: %v", err)
+		return writeOutput(*cc.fOut, append(b, '\n'))
+	}
+	var vars [][2]string
+	for i, t := range tokens {
+		prefix := fmt.Sprintf("GITEA_TOKEN_%d_", i)
+		vars = append(vars,
+			[2]string{prefix + "ID", fmt.Sprint(t.ID)},
+			[2]string{prefix + "NAME", t.Name},
+			[2]string{prefix + "LAST_EIGHT", t.TokenLastEight},
+		)
+	}
+	return writeEnvFile(*cc.fOut, vars)
+}
+
+// revoke deletes the token of username given by -id, or all of their tokens
+// with -all
+func (cc *contributorCmd) revoke(username string) error {
+	found := false
+	for _, t := range cc.tokens(username) {
+		if *cc.fAll || t.ID == *cc.fID {
+			cc.deleteToken(username, t)
+			found = true
+		}
+	}
+	if !found && !*cc.fAll {
+		raise("%v has no token with ID %v", username, *cc.fID)
+	}
+	return nil
+}
+
+// writeCredentials writes the credentials of username, authenticating with
+// token, to -out in the format given by -format
+func (cc *contributorCmd) writeCredentials(username string, token *gitea.AccessToken) error {
+	return writeCredentials(*cc.fOut, *cc.fFormat, username, token)
+}
+
+// writeCredentials writes token to path (see writeOutput) either as the JSON
+// access token, or as an env file of the contributor credentials used by
+// serve
+func writeCredentials(path, format, username string, token *gitea.AccessToken) error {
+	if format == "env" {
+		return writeEnvFile(path, [][2]string{
+			{EnvContributorUser, username},
+			{EnvContributorPassword, token.Token},
+		})
+	}
+	b, err := json.Marshal(token)
+	check(err, "failed to JSON-marshal token: %v", err)
+	return writeOutput(path, append(b, '\n'))
+}
+
+// ensureContributor returns the contributor account username, creating it if
+// it does not exist. Either way, the account is made an admin so that it can
+// provision users.
+func (r *runner) ensureContributor(client *gitea.Client, username, email, fullName string) *gitea.User {
+	yes := true
+	no := false
+
+	user, resp, err := client.GetUserInfo(username)
+	switch {
+	case err == nil:
+		r.logger.Info("contributor exists", "user", username)
+	case resp != nil && resp.StatusCode == http.StatusNotFound:
+		if fullName == "" {
+			fullName = username
+		}
+		// The password is never used: the contributor authenticates with
+		// access tokens, which are issued via sudo (see sudoClient)
+		user, _, err = client.AdminCreateUser(gitea.CreateUserOption{
+			Email:              email,
+			FullName:           fullName,
+			LoginName:          username,
+			MustChangePassword: &no,
+			Password:           randomPassword(),
+			SendNotify:         false,
+			Username:           username,
+			SourceID:           0,
+		})
+		check(err, "failed to create new contributor %v: %v", username, err)
+		r.logger.Info("created contributor", "user", username)
+	default:
+		raise("failed to get user %v: %v", username, err)
+	}
+
+	if !user.IsAdmin {
+		_, err = client.AdminEditUser(user.UserName, gitea.EditUserOption{
+			Admin:     &yes,
+			LoginName: user.UserName,
+			Email:     &user.Email,
+			FullName:  &user.FullName,
+			SourceID:  0,
+		})
+		check(err, "failed to edit contributor %v: %v", user.UserName, err)
+	}
+	return user
+}
+
+// sudoClient returns a client authenticated with the root credentials that
+// acts as username. Gitea only allows a user's tokens to be managed with basic
+// authentication as that user, which this satisfies without us needing to
+// know their password.
+func (r *runner) sudoClient(username string) *gitea.Client {
+	user, password := r.rootCredentials()
+	client, err := r.newGiteaClient(user, password, gitea.SetSudo(username))
+	check(err, "failed to create root client: %v", err)
+	return client
+}
+
+// tokens returns the access tokens of username
+func (r *runner) tokens(username string) []*gitea.AccessToken {
+	client := r.sudoClient(username)
+	var res []*gitea.AccessToken
+	opt := gitea.ListAccessTokensOptions{
+		ListOptions: gitea.ListOptions{
+			Page:     1,
+			PageSize: 10,
+		},
+	}
+	for {
+		tokens, _, err := client.ListAccessTokens(opt)
+		check(err, "failed to list access tokens of %v: %v", username, err)
+		res = append(res, tokens...)
+		if len(tokens) < opt.PageSize {
+			break
+		}
+		opt.Page++
+	}
+	return res
+}
+
+// deleteToken revokes the access token t of username
+func (r *runner) deleteToken(username string, t *gitea.AccessToken) {
+	_, err := r.sudoClient(username).DeleteAccessToken(t.ID)
+	check(err, "failed to delete access token %q of %v: %v", t.Name, username, err)
+	r.logger.Info("deleted access token", "user", username, "id", t.ID, "name", t.Name)
+}
+
+// issueToken creates an access token named name for username. Any existing
+// token of the same name is replaced.
+func (r *runner) issueToken(username, name string) *gitea.AccessToken {
+	for _, t := range r.tokens(username) {
+		if t.Name == name {
+			r.deleteToken(username, t)
+		}
+	}
+	token, _, err := r.sudoClient(username).CreateAccessToken(gitea.CreateAccessTokenOption{
+		Name: name,
+	})
+	check(err, "failed to create access token for %v: %v", username, err)
+	r.logger.Info("created access token", "user", username, "name", name)
+	return token
+}
+
+// validToken reports whether token authenticates as username
+func (r *runner) validToken(username, token string) bool {
+	if token == "" {
+		return false
+	}
+	c, err := r.newGiteaClient(username, token)
+	if err != nil {
+		return false
+	}
+	u, _, err := c.GetMyUserInfo()
+	return err == nil && u.UserName == username
+}
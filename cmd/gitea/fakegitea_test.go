@@ -0,0 +1,235 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// This file holds the fixtures shared by the tests of serve: a fake Gitea
+// instance, and serveCmd, provisioner and server values configured to use it.
+
+// newTestServeCmd returns a serveCmd, initialised as if by main, for the
+// Gitea instance at rootURL
+func newTestServeCmd(t *testing.T, rootURL string) *serveCmd {
+	r := newRunner()
+	r.rootCmd = newRootCmd()
+	r.serveCmd = newServeCmd(r)
+	if err := r.rootCmd.fs.Parse([]string{"-rootURL", rootURL}); err != nil {
+		t.Fatal(err)
+	}
+	r.config = new(config)
+	r.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	r.httpClient = new(http.Client)
+	r.hostname = "gopher.live"
+	if err := r.serveCmd.setupIDs(); err != nil {
+		t.Fatal(err)
+	}
+	return r.serveCmd
+}
+
+// newTestProvisioner returns a provisioner for sc, as if serve had found the
+// Gitea instance to be version 1.15.9 with keyscan testKeyScan
+func newTestProvisioner(sc *serveCmd) *provisioner {
+	return sc.newProvisioner("1.15.9", testKeyScan)
+}
+
+// testKeyScan is the keyscan of the Gitea instance used in tests
+const testKeyScan = "gopher.live ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAINN9WGgaNdxN8TZPmXDwI+x+lGIc7IlSq7tZHHyeYqeE"
+
+// newTestServer returns a server that is ready to provision users with p
+func newTestServer(t *testing.T, p *provisioner) *server {
+	s := p.newServer(context.Background(), context.Background())
+	s.p = p
+	close(s.initialised)
+	return s
+}
+
+// fakeGitea implements just enough of the Gitea API to provision users with
+// repositories, and to list and remove them. Like Gitea, it rejects a user
+// that already exists, and the protection of a branch of a repository that
+// was not initialised. It is safe for concurrent use.
+type fakeGitea struct {
+	t *testing.T
+
+	mu    sync.Mutex
+	users map[string]*fakeUser
+
+	// initialised is the set of repos, by full name, created with AutoInit
+	initialised map[string]bool
+
+	// protections records the protection rules created, in the form
+	// "branch owner/repo name" or "tags owner/repo pattern"
+	protections []string
+}
+
+type fakeUser struct {
+	created time.Time
+	repos   []string
+}
+
+func newFakeGitea(t *testing.T) *fakeGitea {
+	return &fakeGitea{
+		t:           t,
+		users:       make(map[string]*fakeUser),
+		initialised: make(map[string]bool),
+	}
+}
+
+// usernames returns the sorted names of the users of f
+func (f *fakeGitea) usernames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := []string{}
+	for u := range f.users {
+		res = append(res, u)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (f *fakeGitea) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	reply := func(status int, v interface{}) {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(status)
+		json.NewEncoder(resp).Encode(v)
+	}
+	var body map[string]interface{}
+	if req.Body != nil {
+		json.NewDecoder(req.Body).Decode(&body)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/v1/"), "/")
+	switch {
+	case req.Method == "GET" && req.URL.Path == "/api/v1/version":
+		reply(http.StatusOK, map[string]string{"version": "1.15.9"})
+	case req.Method == "GET" && len(parts) == 2 && parts[0] == "admin" && parts[1] == "users":
+		var names []string
+		for u := range f.users {
+			names = append(names, u)
+		}
+		sort.Strings(names)
+		users := []interface{}{}
+		for _, u := range fakePage(req, names) {
+			users = append(users, map[string]interface{}{
+				"login":     u,
+				"full_name": TemporaryUserFullName,
+				"created":   f.users[u].created,
+			})
+		}
+		reply(http.StatusOK, users)
+	case req.Method == "POST" && len(parts) == 2 && parts[0] == "admin" && parts[1] == "users":
+		username, _ := body["username"].(string)
+		if f.users[username] != nil {
+			reply(http.StatusUnprocessableEntity, map[string]string{"message": "user already exists"})
+			return
+		}
+		f.users[username] = &fakeUser{created: time.Now().Truncate(time.Second)}
+		reply(http.StatusCreated, map[string]interface{}{
+			"id":        1,
+			"login":     body["username"],
+			"email":     body["email"],
+			"full_name": body["full_name"],
+		})
+	case req.Method == "PATCH" && len(parts) == 3 && parts[0] == "admin" && parts[1] == "users":
+		reply(http.StatusOK, map[string]interface{}{"login": parts[2]})
+	case req.Method == "DELETE" && len(parts) == 3 && parts[0] == "admin" && parts[1] == "users":
+		if u := f.users[parts[2]]; u == nil || len(u.repos) > 0 {
+			reply(http.StatusUnprocessableEntity, map[string]string{"message": "user does not exist or owns repositories"})
+			return
+		}
+		delete(f.users, parts[2])
+		resp.WriteHeader(http.StatusNoContent)
+	case req.Method == "POST" && len(parts) == 4 && parts[0] == "admin" && parts[3] == "keys":
+		reply(http.StatusCreated, map[string]interface{}{"id": 1, "key": body["key"]})
+	case req.Method == "POST" && len(parts) == 4 && parts[0] == "admin" && parts[3] == "repos":
+		if u := f.users[parts[2]]; u != nil {
+			u.repos = append(u.repos, body["name"].(string))
+		}
+		if body["auto_init"] == true {
+			f.initialised[parts[2]+"/"+body["name"].(string)] = true
+		}
+		reply(http.StatusCreated, map[string]interface{}{
+			"id":             1,
+			"name":           body["name"],
+			"full_name":      parts[2] + "/" + body["name"].(string),
+			"default_branch": "main",
+		})
+	case req.Method == "POST" && len(parts) == 4 && parts[0] == "repos" && parts[3] == "branch_protections":
+		repo := parts[1] + "/" + parts[2]
+		if !f.initialised[repo] {
+			reply(http.StatusNotFound, map[string]string{"message": "branch does not exist"})
+			return
+		}
+		f.protections = append(f.protections, "branch "+repo+" "+body["branch_name"].(string))
+		reply(http.StatusCreated, map[string]interface{}{"branch_name": body["branch_name"]})
+	case req.Method == "POST" && len(parts) == 4 && parts[0] == "repos" && parts[3] == "tag_protections":
+		repo := parts[1] + "/" + parts[2]
+		f.protections = append(f.protections, "tags "+repo+" "+body["name_pattern"].(string))
+		reply(http.StatusCreated, map[string]interface{}{"name_pattern": body["name_pattern"]})
+	case req.Method == "GET" && len(parts) == 3 && parts[0] == "users" && parts[2] == "repos":
+		var names []string
+		if u := f.users[parts[1]]; u != nil {
+			names = u.repos
+		}
+		repos := []interface{}{}
+		for _, r := range fakePage(req, names) {
+			repos = append(repos, map[string]interface{}{"name": r})
+		}
+		reply(http.StatusOK, repos)
+	case req.Method == "GET" && len(parts) == 3 && parts[0] == "users" && parts[2] == "keys":
+		reply(http.StatusOK, []interface{}{})
+	case req.Method == "DELETE" && len(parts) == 3 && parts[0] == "repos":
+		u := f.users[parts[1]]
+		if u == nil {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for i, r := range u.repos {
+			if r == parts[2] {
+				u.repos = append(u.repos[:i:i], u.repos[i+1:]...)
+				resp.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		resp.WriteHeader(http.StatusNotFound)
+	default:
+		f.t.Errorf("fake gitea: unexpected request %v %v", req.Method, req.URL.Path)
+		resp.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// fakePage returns the page of items given by the page and limit query
+// parameters of req
+func fakePage(req *http.Request, items []string) []string {
+	page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+	limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 {
+		limit = len(items)
+	}
+	start := (page - 1) * limit
+	if start >= len(items) {
+		return nil
+	}
+	end := start + limit
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[start:end]
+}
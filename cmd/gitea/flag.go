@@ -6,9 +6,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"net/http"
 	"os"
 	"strings"
 	"time"
@@ -32,6 +35,11 @@ func main1() int {
 	r.serveCmd = newServeCmd(r)
 	r.newContributorCmd = newNewContributorCmd(r)
 	r.reapCmd = newReapCmd(r)
+	r.auditCmd = newAuditCmd(r)
+	r.listCmd = newListCmd(r)
+	r.loadTestCmd = newLoadTestCmd(r)
+	r.bootstrapCmd = newBootstrapCmd(r)
+	r.contributorCmd = newContributorCommand(r)
 
 	err := r.mainerr()
 	if err == nil {
@@ -59,9 +67,20 @@ type rootCmd struct {
 	flagDefaults string
 	fDebug       *bool
 	fRootURL     *string
+	fConfig      *string
+	fLogFormat   *string
+	fDebugHTTP   *string
+	fAuditLog    *string
 
 	// hostname is the parse host from -rootURL
 	hostname string
+
+	// logger is the structured logger configured by -logFormat and -debug
+	logger *slog.Logger
+
+	// httpClient is the HTTP client used for all requests to Gitea. With
+	// -debug its transport traces the traffic
+	httpClient *http.Client
 }
 
 func newFlagSet(name string, setupFlags func(*flag.FlagSet)) string {
@@ -92,25 +111,40 @@ func newRootCmd() *rootCmd {
 	res.flagDefaults = newFlagSet("gitea", func(fs *flag.FlagSet) {
 		res.fs = fs
 		res.fDebug = fs.Bool("debug", false, "include debug output")
-		res.fRootURL = fs.String("rootURL", envOrVal("GITEA_ROOT_URL", "https://gopher.live"), "root URL for all requests")
+		res.fRootURL = fs.String("rootURL", "https://gopher.live", "root URL for all requests")
+		res.fConfig = fs.String("config", "", "CUE configuration file")
+		res.fLogFormat = fs.String("logFormat", "text", "log format: text or json")
+		res.fDebugHTTP = fs.String("debugHTTPFile", "", "with -debug, file to which Gitea API traffic is also dumped as JSON lines")
+		res.fAuditLog = fs.String("auditLog", "", "file to which serve and reap append audit events as JSON lines; - for stdout")
 	})
 	return res
 }
 
-func envOrVal(env string, val string) string {
-	if v, ok := os.LookupEnv(env); ok {
-		return v
-	}
-	return val
-}
-
 func (r *rootCmd) usage() string {
 	return fmt.Sprintf(`
 Usage of gitea:
 
 gitea defines the following flags:
 
-%s`[1:], r.flagDefaults)
+%s
+The commands are:
+
+	serve             serve the /newuser prestep endpoint
+	reap              remove old temporary users and their repositories
+	list              list temporary users and their repositories
+	newcontributor    create a contributor account, or reissue its token
+	contributor       manage the access tokens of the contributor account
+	bootstrap         set up a fresh Gitea instance for serve
+	audit             query the audit log
+	loadtest          measure the rate at which serve provisions users
+
+Each flag can also be set via an environment variable, named GITEA_ followed
+by the command name (if any) and the flag name in upper snake case (e.g.
+GITEA_ROOT_URL or GITEA_SERVE_SHUTDOWN_TIMEOUT), or via the CUE configuration
+file given by -config, which is validated against #Config. Settings take their
+value from, in order of precedence: flag, environment variable, configuration
+file, default.
+`[1:], r.flagDefaults)
 }
 
 func (r *rootCmd) usageErr(format string, args ...interface{}) usageErr {
@@ -119,20 +153,55 @@ func (r *rootCmd) usageErr(format string, args ...interface{}) usageErr {
 
 type serveCmd struct {
 	*runner
-	fs           *flag.FlagSet
-	flagDefaults string
-	fPort        *string
-
-	client *gitea.Client
-
-	keyScan string
+	fs                 *flag.FlagSet
+	flagDefaults       string
+	fPort              *string
+	fShutdownTimeout   *time.Duration
+	fTLSCert           *string
+	fTLSKey            *string
+	fTLSClientCA       *string
+	fOTLPEndpoint      *string
+	fStateFile         *string
+	fSessionTTL        *time.Duration
+	fIDFormat          *string
+	fIDPrefix          *string
+	fIDLength          *int
+	fIDAlphabet        *string
+	fUsernamePrefixes  *string
+	fIdempotencyWindow *time.Duration
+
+	// ids generates the IDs from which the names of users and repositories
+	// are formed, per the -id* flags
+	ids idGenerator
+
+	// store is the persistent record of sessions; nil if -stateFile is not
+	// set
+	store *store
+
+	// keyScan returns the ssh-keyscan output for the Gitea instance. It is
+	// runKeyScan other than in tests.
+	keyScan func(ctx context.Context) (string, error)
 }
 
 func newServeCmd(r *runner) *serveCmd {
 	res := &serveCmd{runner: r}
+	res.keyScan = res.runKeyScan
 	res.flagDefaults = newFlagSet("gitea serve", func(fs *flag.FlagSet) {
 		res.fs = fs
 		res.fPort = fs.String("port", "8080", "port on which to listen")
+		res.fShutdownTimeout = fs.Duration("shutdownTimeout", 30*time.Second, "time allowed for in-flight requests to complete on shutdown before they are rolled back")
+		res.fTLSCert = fs.String("tlsCert", "", "TLS certificate file; if set, serve listens over TLS. Reloaded when changed")
+		res.fTLSKey = fs.String("tlsKey", "", "TLS key file. Reloaded when changed")
+		res.fTLSClientCA = fs.String("tlsClientCA", "", "CA certificates file used to require and verify client certificates (mutual TLS). Reloaded when changed")
+		res.fOTLPEndpoint = fs.String("otlpEndpoint", "", "OTLP/HTTP endpoint URL (e.g. http://localhost:4318) to which traces are exported; tracing is disabled if empty")
+		res.fStateFile = fs.String("stateFile", "", "file in which sessions are persisted, and reconciled with Gitea at startup; serve is stateless if empty")
+		res.fSessionTTL = fs.Duration("sessionTTL", 3*time.Hour, "time after which a session expires")
+		res.fIDFormat = fs.String("idFormat", "counter", "format of the IDs in the names of users and repositories: counter (a monotonic counter plus random characters) or words (adjective-noun-counter)")
+		res.fIDPrefix = fs.String("idPrefix", "u", "prefix of the usernames of temporary users")
+		res.fIDLength = fs.Int("idLength", 12, "length of counter IDs")
+		res.fIDAlphabet = fs.String("idAlphabet", defaultIDAlphabet, "alphabet of counter IDs, from a-z and 0-9")
+		res.fUsernamePrefixes = fs.String("usernamePrefixes", "", "comma-separated list of prefixes with which the UsernamePattern of a request must begin; requests may not specify a UsernamePattern if empty")
+		res.fIdempotencyWindow = fs.Duration("idempotencyWindow", time.Hour, "time for which the response to a /newuser request with an Idempotency-Key header is replayed to repeats of the request; idempotency keys are ignored if zero")
 	})
 	return res
 }
@@ -154,6 +223,7 @@ type newContributorCmd struct {
 	fEmail       *string
 	fFullName    *string
 	fUsername    *string
+	fFormat      *string
 	flagDefaults string
 }
 
@@ -164,6 +234,7 @@ func newNewContributorCmd(r *runner) *newContributorCmd {
 		res.fEmail = fs.String("email", "", "New contributor email address")
 		res.fUsername = fs.String("username", "", "New contributor username")
 		res.fFullName = fs.String("fullname", "", "New contributor full name")
+		res.fFormat = fs.String("format", "json", "output format of the token: json, or env for an env file of the contributor credentials")
 	})
 	return res
 }
@@ -172,6 +243,9 @@ func (i *newContributorCmd) usage() string {
 	return fmt.Sprintf(`
 usage: gitea newcontributor
 
+Creates a contributor account, with admin rights, and an access token for it.
+If the account already exists it is reused, and its token is reissued.
+
 %s`[1:], i.flagDefaults)
 }
 
@@ -210,6 +284,228 @@ func (i *reapCmd) usageErr(format string, args ...interface{}) usageErr {
 	return usageErr{fmt.Errorf(format, args...), i}
 }
 
+type contributorCmd struct {
+	*runner
+	fs           *flag.FlagSet
+	fUsername    *string
+	fFormat      *string
+	fOut         *string
+	fTokenName   *string
+	fKeepOld     *bool
+	fID          *int64
+	fAll         *bool
+	flagDefaults string
+}
+
+// newContributorCommand is so named because newContributorCmd is the type of
+// the newcontributor command
+func newContributorCommand(r *runner) *contributorCmd {
+	res := &contributorCmd{runner: r}
+	res.flagDefaults = newFlagSet("gitea contributor", func(fs *flag.FlagSet) {
+		res.fs = fs
+		res.fUsername = fs.String("username", "", "contributor username; defaults to the contributor user of serve")
+		res.fFormat = fs.String("format", "json", "output format: json or env")
+		res.fOut = fs.String("out", "-", "file to which output is written; - for stdout")
+		res.fTokenName = fs.String("tokenName", "contributor", "rotate-token: base name of the token")
+		res.fKeepOld = fs.Bool("keepOld", false, "rotate-token: do not revoke the previous tokens")
+		res.fID = fs.Int64("id", 0, "revoke: ID of the token to revoke")
+		res.fAll = fs.Bool("all", false, "revoke: revoke all tokens")
+	})
+	return res
+}
+
+func (i *contributorCmd) usage() string {
+	return fmt.Sprintf(`
+usage: gitea contributor <subcommand> [flags]
+
+The subcommands are:
+
+	rotate-token    issue a new access token, named -tokenName with a
+	                timestamp suffix, and revoke the previous ones; the
+	                token is written as JSON, or as an env file for serve
+	list-tokens     list the access tokens (IDs, names and last eight
+	                characters)
+	revoke          revoke the access token given by -id, or all with -all
+
+%s`[1:], i.flagDefaults)
+}
+
+func (i *contributorCmd) usageErr(format string, args ...interface{}) usageErr {
+	return usageErr{fmt.Errorf(format, args...), i}
+}
+
+type bootstrapCmd struct {
+	*runner
+	fs           *flag.FlagSet
+	fUsername    *string
+	fEmail       *string
+	fFullName    *string
+	fTokenName   *string
+	fOrgs        *string
+	fRepos       *string
+	fEnvFile     *string
+	flagDefaults string
+}
+
+func newBootstrapCmd(r *runner) *bootstrapCmd {
+	res := &bootstrapCmd{runner: r}
+	res.flagDefaults = newFlagSet("gitea bootstrap", func(fs *flag.FlagSet) {
+		res.fs = fs
+		res.fUsername = fs.String("username", "contributor", "contributor username")
+		res.fEmail = fs.String("email", "", "contributor email address; defaults to username@host")
+		res.fFullName = fs.String("fullname", "", "contributor full name; defaults to the username")
+		res.fTokenName = fs.String("tokenName", "bootstrap", "name of the contributor access token")
+		res.fOrgs = fs.String("orgs", "", "comma-separated list of shared organisations to create")
+		res.fRepos = fs.String("repos", "", "comma-separated list of owner/name fixture repositories to create")
+		res.fEnvFile = fs.String("envFile", "contributor.env", "file to which the contributor credentials are written; - for stdout")
+	})
+	return res
+}
+
+func (i *bootstrapCmd) usage() string {
+	return fmt.Sprintf(`
+usage: gitea bootstrap
+
+Brings a fresh Gitea instance, once migrated and with a root user, to the state
+serve needs: a contributor account with an access token, and the shared
+organisations and fixture repositories. The contributor credentials are
+written to an env file. Running bootstrap again is safe: existing accounts,
+organisations and repositories are left as they are, and the token in the env
+file is reused if it is still valid.
+
+%s`[1:], i.flagDefaults)
+}
+
+func (i *bootstrapCmd) usageErr(format string, args ...interface{}) usageErr {
+	return usageErr{fmt.Errorf(format, args...), i}
+}
+
+type listCmd struct {
+	*runner
+	fs           *flag.FlagSet
+	fFormat      *string
+	fUser        *string
+	fMinAge      *time.Duration
+	fMaxAge      *time.Duration
+	flagDefaults string
+}
+
+func newListCmd(r *runner) *listCmd {
+	res := &listCmd{runner: r}
+	res.flagDefaults = newFlagSet("gitea list", func(fs *flag.FlagSet) {
+		res.fs = fs
+		res.fFormat = fs.String("format", "table", "output format: table or json")
+		res.fUser = fs.String("user", "", "only list users matching this pattern (see path.Match)")
+		res.fMinAge = fs.Duration("minAge", 0, "only list users at least this old")
+		res.fMaxAge = fs.Duration("maxAge", 0, "only list users at most this old; no limit if zero")
+	})
+	return res
+}
+
+func (i *listCmd) usage() string {
+	return fmt.Sprintf(`
+usage: gitea list
+
+Lists the temporary users created by serve, with the size and time of the
+last push of each of their repositories.
+
+%s`[1:], i.flagDefaults)
+}
+
+func (i *listCmd) usageErr(format string, args ...interface{}) usageErr {
+	return usageErr{fmt.Errorf(format, args...), i}
+}
+
+type auditCmd struct {
+	*runner
+	fs           *flag.FlagSet
+	fUser        *string
+	fEvent       *string
+	fSince       *string
+	fUntil       *string
+	flagDefaults string
+}
+
+func newAuditCmd(r *runner) *auditCmd {
+	res := &auditCmd{runner: r}
+	res.flagDefaults = newFlagSet("gitea audit", func(fs *flag.FlagSet) {
+		res.fs = fs
+		res.fUser = fs.String("user", "", "only show events for users matching this pattern (see path.Match)")
+		res.fEvent = fs.String("event", "", "only show events of this type, e.g. user.created")
+		res.fSince = fs.String("since", "", "only show events at or after this RFC 3339 time, or this duration ago")
+		res.fUntil = fs.String("until", "", "only show events before this RFC 3339 time, or this duration ago")
+	})
+	return res
+}
+
+func (i *auditCmd) usage() string {
+	return fmt.Sprintf(`
+usage: gitea audit [file...]
+
+Prints the events in the audit log files (by default the file given by
+-auditLog) that match all of the given filters.
+
+%s`[1:], i.flagDefaults)
+}
+
+func (i *auditCmd) usageErr(format string, args ...interface{}) usageErr {
+	return usageErr{fmt.Errorf(format, args...), i}
+}
+
+type loadTestCmd struct {
+	*runner
+	fs           *flag.FlagSet
+	fURL         *string
+	fSpec        *string
+	fRequests    *int
+	fDuration    *time.Duration
+	fRate        *float64
+	fConcurrency *int
+	fTimeout     *time.Duration
+	fCleanup     *string
+	fFormat      *string
+	fPattern     *string
+	flagDefaults string
+}
+
+func newLoadTestCmd(r *runner) *loadTestCmd {
+	res := &loadTestCmd{runner: r}
+	res.flagDefaults = newFlagSet("gitea loadtest", func(fs *flag.FlagSet) {
+		res.fs = fs
+		res.fURL = fs.String("url", "http://localhost:8080", "base URL of the serve instance under test")
+		res.fSpec = fs.String("spec", "", "file containing the gitea.NewUser request to make, as JSON; an empty request if not set")
+		res.fRequests = fs.Int("requests", 100, "number of requests to make; no limit if zero, in which case -duration must be set")
+		res.fDuration = fs.Duration("duration", 0, "time after which no more requests are started; no limit if zero")
+		res.fRate = fs.Float64("rate", 0, "number of requests started per second; no limit if zero")
+		res.fConcurrency = fs.Int("concurrency", 10, "maximum number of requests in flight")
+		res.fTimeout = fs.Duration("timeout", 2*time.Minute, "time allowed for each request")
+		res.fCleanup = fs.String("cleanup", "none", "what to remove afterwards: none; release, the users returned by successful requests; or reap, the users created since the test started whose names match -usernamePattern, including those of requests that failed or timed out")
+		res.fFormat = fs.String("format", "text", "report format: text or json")
+		res.fPattern = fs.String("usernamePattern", "loadtest-*", "UsernamePattern of the users created, overriding that of -spec, by which they are told apart from those of other clients; serve must allow its prefix via -usernamePrefixes. The pattern of -spec, if any, is used if empty, in which case -cleanup=reap is not allowed")
+	})
+	return res
+}
+
+func (i *loadTestCmd) usage() string {
+	return fmt.Sprintf(`
+usage: gitea loadtest
+
+Makes /newuser requests to a serve instance at the rate and concurrency
+given, and reports the latency of successful requests and a breakdown of the
+errors. Requests are not retried. Cleaning up requires root credentials.
+
+The users created are named per -usernamePattern, so that they can be told
+apart from those of other clients, for example the participants of a
+workshop, which are never removed. serve must allow the pattern's prefix
+via -usernamePrefixes.
+
+%s`[1:], i.flagDefaults)
+}
+
+func (i *loadTestCmd) usageErr(format string, args ...interface{}) usageErr {
+	return usageErr{fmt.Errorf(format, args...), i}
+}
+
 func check(err error, format string, args ...interface{}) {
 	if err != nil {
 		if format != "" {
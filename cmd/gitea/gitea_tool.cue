@@ -29,8 +29,8 @@ command: genimagebases: {
 		# The code generated warning and comment regarding the syntax reference are not at the top of the file
 		# because the syntax line must be the first in the file.
 
-		# golang:1.19.1
-		FROM --platform=$BUILDPLATFORM golang@sha256:2d17ffd12a2cdb25d4a633ad25f8dc29608ed84f31b3b983427d825280427095 AS stage1
+		# golang:1.21.13
+		FROM --platform=$BUILDPLATFORM golang:1.21.13 AS stage1
 
 		ENV GOCACHE=/root/.cache/go/gocache
 		ENV GOMODCACHE=/root/.cache/go/gomodcache
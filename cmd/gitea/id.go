@@ -0,0 +1,163 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultIDAlphabet is the default alphabet of counter IDs. Gitea
+	// usernames are case-insensitive, so an alphabet must not rely on case
+	// to distinguish IDs; we simply require lowercase.
+	defaultIDAlphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+	// idRandomChars is the number of random characters at the end of a
+	// counter ID
+	idRandomChars = 4
+
+	// maxUsernameLength is the maximum length of a Gitea username
+	maxUsernameLength = 40
+)
+
+// start is the epoch of the counter of counterIDs
+var start = time.Date(2019, time.December, 19, 12, 00, 0, 0, time.UTC)
+
+// idPrefixRegexp matches a valid -idPrefix
+var idPrefixRegexp = regexp.MustCompile(`^([a-z0-9][a-z0-9_-]*)?$`)
+
+// idGenerator generates the unique IDs from which the names of temporary
+// users and repositories are formed. Implementations are safe for concurrent
+// use.
+type idGenerator interface {
+	newID() string
+}
+
+// newIDGenerator returns the idGenerator of the given format, counter or
+// words. length and alphabet only apply to counter IDs.
+func newIDGenerator(format string, length int, alphabet string) (idGenerator, error) {
+	switch format {
+	case "counter":
+		return newCounterIDs(length, alphabet)
+	case "words":
+		return new(wordIDs), nil
+	}
+	return nil, fmt.Errorf("unknown ID format %q", format)
+}
+
+// counterIDs generates IDs of a fixed length: a monotonic counter followed by
+// idRandomChars random characters, all drawn from an alphabet.
+//
+// The counter starts at the number of milliseconds since start, such that
+// IDs remain unique across restarts provided that on average fewer than one
+// ID per millisecond is generated. The counter wraps once it exceeds the
+// capacity of the characters available to it, which for the default length
+// and alphabet is after more than 80 years; the random characters then
+// distinguish IDs, as they do those of separate instances of serve.
+type counterIDs struct {
+	alphabet string
+	width    int
+	counter  uint64
+}
+
+func newCounterIDs(length int, alphabet string) (*counterIDs, error) {
+	if len(alphabet) < 2 {
+		return nil, fmt.Errorf("ID alphabet must have at least two characters")
+	}
+	for i, r := range alphabet {
+		if !('a' <= r && r <= 'z' || '0' <= r && r <= '9') {
+			return nil, fmt.Errorf("invalid character %q in ID alphabet: must be a-z or 0-9", r)
+		}
+		if strings.IndexRune(alphabet, r) != i {
+			return nil, fmt.Errorf("duplicate character %q in ID alphabet", r)
+		}
+	}
+	if length <= idRandomChars {
+		return nil, fmt.Errorf("ID length must be greater than %d", idRandomChars)
+	}
+	return &counterIDs{
+		alphabet: alphabet,
+		width:    length - idRandomChars,
+		counter:  uint64(time.Since(start) / time.Millisecond),
+	}, nil
+}
+
+func (c *counterIDs) newID() string {
+	n := atomic.AddUint64(&c.counter, 1)
+	base := uint64(len(c.alphabet))
+	b := make([]byte, c.width+idRandomChars)
+	for i := c.width - 1; i >= 0; i-- {
+		b[i] = c.alphabet[n%base]
+		n /= base
+	}
+	for i := c.width; i < len(b); i++ {
+		b[i] = c.alphabet[randIndex(len(c.alphabet))]
+	}
+	return string(b)
+}
+
+// wordIDs generates human-friendly IDs of the form adjective-noun-n, for
+// example brave-gopher-7, where n is a counter. IDs are unique for the
+// lifetime of the process; after a restart a duplicate is possible, but is
+// rejected by Gitea and retried.
+type wordIDs struct {
+	counter uint64
+}
+
+func (w *wordIDs) newID() string {
+	n := atomic.AddUint64(&w.counter, 1)
+	adj := idAdjectives[randIndex(len(idAdjectives))]
+	noun := idNouns[randIndex(len(idNouns))]
+	return fmt.Sprintf("%v-%v-%v", adj, noun, n)
+}
+
+// maxIDLength returns the maximum length of the IDs generated by ids
+func maxIDLength(ids idGenerator) int {
+	switch ids := ids.(type) {
+	case *counterIDs:
+		return ids.width + idRandomChars
+	case *wordIDs:
+		// The longest words, and a counter of up to six digits
+		return maxLen(idAdjectives) + 1 + maxLen(idNouns) + 1 + 6
+	}
+	panic(fmt.Errorf("unknown idGenerator %T", ids))
+}
+
+func maxLen(words []string) int {
+	res := 0
+	for _, w := range words {
+		if len(w) > res {
+			res = len(w)
+		}
+	}
+	return res
+}
+
+// randIndex returns a uniformly random index in [0, n)
+func randIndex(n int) int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	check(err, "failed to read a random stream of bytes: %v", err)
+	return int(i.Int64())
+}
+
+var idAdjectives = []string{
+	"agile", "bold", "brave", "bright", "calm", "clever", "cosmic", "curious",
+	"daring", "eager", "fancy", "fast", "gentle", "happy", "humble", "jolly",
+	"keen", "kind", "lively", "lucky", "merry", "mighty", "nimble", "noble",
+	"plucky", "proud", "quick", "quiet", "sharp", "shiny", "swift", "witty",
+}
+
+var idNouns = []string{
+	"badger", "beaver", "bison", "crane", "dolphin", "eagle", "falcon", "ferret",
+	"fox", "gecko", "gopher", "hare", "heron", "ibis", "koala", "lemur",
+	"lynx", "marmot", "mole", "newt", "otter", "owl", "panda", "puffin",
+	"quokka", "raven", "robin", "seal", "stoat", "tapir", "walrus", "wombat",
+}
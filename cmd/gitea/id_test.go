@@ -0,0 +1,74 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"regexp"
+	"sync"
+	"testing"
+)
+
+func TestIDGenerator(t *testing.T) {
+	for _, tc := range []struct {
+		format   string
+		length   int
+		alphabet string
+		want     *regexp.Regexp
+	}{
+		{"counter", 12, defaultIDAlphabet, regexp.MustCompile(`^[0-9a-z]{12}$`)},
+		{"counter", 20, "0123456789abcdef", regexp.MustCompile(`^[0-9a-f]{20}$`)},
+		{"words", 0, "", regexp.MustCompile(`^[a-z]+-[a-z]+-[0-9]+$`)},
+	} {
+		ids, err := newIDGenerator(tc.format, tc.length, tc.alphabet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Generate IDs concurrently, as concurrent requests do
+		const workers, perWorker = 8, 500
+		var mu sync.Mutex
+		seen := make(map[string]bool)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < perWorker; j++ {
+					id := ids.newID()
+					mu.Lock()
+					if seen[id] {
+						t.Errorf("%v: duplicate ID %q", tc.format, id)
+					}
+					seen[id] = true
+					mu.Unlock()
+					if !tc.want.MatchString(id) {
+						t.Errorf("%v: ID %q does not match %v", tc.format, id, tc.want)
+					}
+					if len(id) > maxIDLength(ids) {
+						t.Errorf("%v: ID %q is longer than %d", tc.format, id, maxIDLength(ids))
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func TestIDGeneratorInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		format   string
+		length   int
+		alphabet string
+	}{
+		{"uuid", 12, defaultIDAlphabet},
+		{"counter", idRandomChars, defaultIDAlphabet},
+		{"counter", 12, "a"},
+		{"counter", 12, "abcA"},
+		{"counter", 12, "abca"},
+	} {
+		if _, err := newIDGenerator(tc.format, tc.length, tc.alphabet); err == nil {
+			t.Errorf("newIDGenerator(%q, %d, %q) succeeded; want error", tc.format, tc.length, tc.alphabet)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// headerIdempotencyKey is the header by which a client identifies the
+	// repeats of a /newuser request, such that retrying a request whose
+	// response was lost does not create a second user
+	headerIdempotencyKey = "Idempotency-Key"
+
+	// headerIdempotentReplayed is set on a response that is replayed to a
+	// repeated request
+	headerIdempotentReplayed = "Idempotent-Replayed"
+
+	// maxIdempotencyKeyLength is the maximum length of an idempotency key
+	maxIdempotencyKeyLength = 255
+
+	// idempotencySweepInterval is the minimum interval between sweeps of
+	// the expired entries of an idempotencyCache
+	idempotencySweepInterval = time.Minute
+)
+
+// idempotencyCache holds the responses to requests made with an idempotency
+// key, such that repeats of a request are replayed its response rather than
+// handled afresh. A response is replayed for -idempotencyWindow after it
+// completes; requests that arrive while it is in progress wait for it. It is
+// safe for concurrent use.
+type idempotencyCache struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*idempotentEntry
+	lastSweep time.Time
+}
+
+// idempotentEntry is the response to the first request with a given key
+type idempotentEntry struct {
+	// digest is the SHA256 digest of the body of the request
+	digest [sha256.Size]byte
+
+	// done is closed once the request has been handled, at which point
+	// stored reports whether its response was stored. A response is not
+	// stored if the request failed in a way that may succeed if retried,
+	// in which case the entry is removed.
+	done   chan struct{}
+	stored bool
+	status int
+	header http.Header
+	body   []byte
+
+	// expires is the time after which the entry is removed; zero until
+	// the response is stored. It is guarded by idempotencyCache.mu.
+	expires time.Time
+}
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		window:  window,
+		entries: make(map[string]*idempotentEntry),
+	}
+}
+
+// start returns the entry for id. If there is none, or it has expired, a new
+// entry is created for the request with the given digest, first is true, and
+// the caller must complete it.
+func (c *idempotencyCache) start(id string, digest [sha256.Size]byte) (e *idempotentEntry, first bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastSweep) >= idempotencySweepInterval {
+		for id, e := range c.entries {
+			if e.expired(now) {
+				delete(c.entries, id)
+			}
+		}
+		c.lastSweep = now
+	}
+	if e := c.entries[id]; e != nil && !e.expired(now) {
+		return e, false
+	}
+	e = &idempotentEntry{
+		digest: digest,
+		done:   make(chan struct{}),
+	}
+	c.entries[id] = e
+	return e, true
+}
+
+// complete records rec, the response to the request of e, releasing the
+// requests that wait for it. Server errors, and responses that were never
+// written because the handler panicked, are not stored: they may not recur,
+// hence a retry is handled afresh.
+func (c *idempotencyCache) complete(id string, e *idempotentEntry, rec *responseRecorder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rec.wroteHeader && rec.status < 500 {
+		e.stored = true
+		e.status = rec.status
+		e.header = rec.Header().Clone()
+		e.body = rec.body.Bytes()
+		e.expires = time.Now().Add(c.window)
+	} else if c.entries[id] == e {
+		delete(c.entries, id)
+	}
+	close(e.done)
+}
+
+func (e *idempotentEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// idempotent returns a handler that handles requests with h, other than the
+// repeats of a request made with an idempotency key, to which the response to
+// the first is replayed. Keys are scoped to the path and the caller. A key
+// must not be reused for a different request. Errors are written with
+// writeErr.
+func (s *server) idempotent(h http.HandlerFunc, writeErr func(resp http.ResponseWriter, status int, err error)) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(headerIdempotencyKey)
+		if key == "" || s.idempotency == nil {
+			h(resp, req)
+			return
+		}
+		fail := func(status int, err error) {
+			resp.Header().Set(headerRequestID, requestID(req))
+			writeErr(resp, status, err)
+		}
+		if len(key) > maxIdempotencyKeyLength || !isPrintableASCII(key) {
+			fail(http.StatusBadRequest, fmt.Errorf("invalid %v: must be at most %d printable ASCII characters", headerIdempotencyKey, maxIdempotencyKeyLength))
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			fail(http.StatusBadRequest, fmt.Errorf("failed to read request: %v", err))
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		digest := sha256.Sum256(body)
+		id := req.URL.Path + "\x00" + requestCaller(req) + "\x00" + key
+
+		for {
+			e, first := s.idempotency.start(id, digest)
+			if first {
+				rec := &responseRecorder{ResponseWriter: resp, status: http.StatusOK}
+				defer s.idempotency.complete(id, e, rec)
+				h(rec, req)
+				return
+			}
+			if e.digest != digest {
+				fail(http.StatusUnprocessableEntity, fmt.Errorf("%v %q was used for a different request", headerIdempotencyKey, key))
+				return
+			}
+			select {
+			case <-e.done:
+			case <-req.Context().Done():
+				return
+			}
+			if e.stored {
+				log := s.requestLogger(req, requestID(req))
+				log.Info("replayed response", "replayed_request_id", e.header.Get(headerRequestID), "status", e.status)
+				for k, v := range e.header {
+					resp.Header()[k] = v
+				}
+				resp.Header().Set(headerIdempotentReplayed, "true")
+				resp.WriteHeader(e.status)
+				resp.Write(e.body)
+				return
+			}
+			// The first request failed, but may succeed if retried
+		}
+	}
+}
+
+// responseRecorder records the response written through it to the
+// ResponseWriter it wraps
+type responseRecorder struct {
+	http.ResponseWriter
+	wroteHeader bool
+	status      int
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.wroteHeader = true
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
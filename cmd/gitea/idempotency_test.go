@@ -0,0 +1,181 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/play-with-go/gitea"
+)
+
+// TestIdempotencyKey verifies that repeats of a /newuser request with an
+// Idempotency-Key header are replayed the response to the first, including
+// those that arrive while it is in progress.
+func TestIdempotencyKey(t *testing.T) {
+	newServer := func(setup func(sc *serveCmd)) (*fakeGitea, *httptest.Server) {
+		fake := newFakeGitea(t)
+		gs := httptest.NewServer(fake)
+		t.Cleanup(gs.Close)
+		sc := newTestServeCmd(t, gs.URL)
+		if setup != nil {
+			setup(sc)
+		}
+		srv := httptest.NewServer(newTestServer(t, newTestProvisioner(sc)).handler())
+		t.Cleanup(srv.Close)
+		return fake, srv
+	}
+	body, err := json.Marshal(contractRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(srv *httptest.Server, path, key string, body []byte) (*http.Response, []byte) {
+		req, err := http.NewRequest("POST", srv.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Set(headerIdempotencyKey, key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+		return resp, buf.Bytes()
+	}
+	username := func(resp *http.Response, body []byte) string {
+		var sess gitea.Session
+		if err := json.Unmarshal(body, &sess); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %v, %v: %s", resp.StatusCode, err, body)
+		}
+		return sess.Username
+	}
+
+	t.Run("Sequential", func(t *testing.T) {
+		fake, srv := newServer(nil)
+		resp1, body1 := post(srv, "/v2/newuser", "key1", body)
+		resp2, body2 := post(srv, "/v2/newuser", "key1", body)
+		if u1, u2 := username(resp1, body1), username(resp2, body2); u1 != u2 {
+			t.Errorf("got users %v and %v; want the same", u1, u2)
+		}
+		if !bytes.Equal(body1, body2) {
+			t.Errorf("replayed response differs from the original")
+		}
+		if resp1.Header.Get(headerIdempotentReplayed) != "" || resp2.Header.Get(headerIdempotentReplayed) != "true" {
+			t.Errorf("got %v headers %q and %q", headerIdempotentReplayed, resp1.Header.Get(headerIdempotentReplayed), resp2.Header.Get(headerIdempotentReplayed))
+		}
+		if got := resp2.Header.Get(headerRequestID); got != resp1.Header.Get(headerRequestID) {
+			t.Errorf("replayed response has request ID %v; want that of the original, %v", got, resp1.Header.Get(headerRequestID))
+		}
+
+		// A different key, or path, is a different request
+		username(post(srv, "/v2/newuser", "key2", body))
+		username(post(srv, "/v2/newuser", "", body))
+		if resp, out := post(srv, "/v1/newuser", "key1", body); resp.StatusCode != http.StatusOK {
+			t.Errorf("got status %v for /v1/newuser: %s", resp.StatusCode, out)
+		}
+		if got := fake.usernames(); len(got) != 4 {
+			t.Errorf("got users %v; want 4", got)
+		}
+
+		// A key cannot be reused for a different request
+		resp, out := post(srv, "/v2/newuser", "key1", []byte(`{}`))
+		var e apiError
+		if err := json.Unmarshal(out, &e); err != nil || resp.StatusCode != http.StatusUnprocessableEntity || e.RequestID == "" {
+			t.Errorf("got status %v, %v: %s for a reused key", resp.StatusCode, err, out)
+		}
+		if resp, out := post(srv, "/v2/newuser", "kéy", body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("got status %v for an invalid key: %s", resp.StatusCode, out)
+		}
+	})
+
+	t.Run("Logged", func(t *testing.T) {
+		var log bytes.Buffer
+		_, srv := newServer(func(sc *serveCmd) {
+			sc.logger = slog.New(slog.NewTextHandler(&log, nil))
+		})
+		resp1, _ := post(srv, "/v2/newuser", "key", body)
+		req, err := http.NewRequest("POST", srv.URL+"/v2/newuser", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(headerIdempotencyKey, "key")
+		req.Header.Set(headerRequestID, "r1234")
+		resp2, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp2.Body.Close()
+		if resp2.Header.Get(headerIdempotentReplayed) != "true" {
+			t.Fatalf("response not replayed")
+		}
+		want := fmt.Sprintf("msg=\"replayed response\" request_id=r1234 replayed_request_id=%v status=200", resp1.Header.Get(headerRequestID))
+		if !strings.Contains(log.String(), want) {
+			t.Errorf("log does not contain %q:\n%s", want, log.String())
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		fake, srv := newServer(nil)
+		const n = 10
+		var wg sync.WaitGroup
+		usernames := make([]string, n)
+		for i := 0; i < n; i++ {
+			i := i
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, _ := http.NewRequest("POST", srv.URL+"/v2/newuser", bytes.NewReader(body))
+				req.Header.Set(headerIdempotencyKey, "key")
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer resp.Body.Close()
+				var sess gitea.Session
+				if err := json.NewDecoder(resp.Body).Decode(&sess); err != nil || resp.StatusCode != http.StatusOK {
+					t.Errorf("got status %v, %v", resp.StatusCode, err)
+				}
+				usernames[i] = sess.Username
+			}()
+		}
+		wg.Wait()
+		for _, u := range usernames[1:] {
+			if u != usernames[0] {
+				t.Errorf("got users %v; want all the same", usernames)
+				break
+			}
+		}
+		if got := fake.usernames(); len(got) != 1 {
+			t.Errorf("got users %v; want 1", got)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		fake, srv := newServer(func(sc *serveCmd) {
+			if err := sc.fs.Set("idempotencyWindow", "1ns"); err != nil {
+				t.Fatal(err)
+			}
+		})
+		username(post(srv, "/v2/newuser", "key", body))
+		username(post(srv, "/v2/newuser", "key", body))
+		if got := fake.usernames(); len(got) != 2 {
+			t.Errorf("got users %v; want 2", got)
+		}
+	})
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"code.gitea.io/sdk/gitea"
+)
+
+// listedUser is a temporary user as reported by list
+type listedUser struct {
+	User    string
+	Created time.Time
+	Age     string
+	Repos   []listedRepo
+}
+
+type listedRepo struct {
+	Name string
+
+	// Size is the size of the repository in KiB
+	Size int
+
+	// LastPush is the time the repository was last updated, which Gitea
+	// sets on push. It is omitted for empty repositories.
+	LastPush *time.Time `json:",omitempty"`
+}
+
+func (lc *listCmd) run(args []string) error {
+	if err := lc.fs.Parse(args); err != nil {
+		return lc.usageErr("failed to parse flags: %v", err)
+	}
+	if err := lc.config.applyFlags(lc.fs, "list"); err != nil {
+		return lc.usageErr("%v", err)
+	}
+	if len(lc.fs.Args()) > 0 {
+		return lc.usageErr("list does not take any arguments")
+	}
+	switch *lc.fFormat {
+	case "table", "json":
+	default:
+		return lc.usageErr("unknown -format %q", *lc.fFormat)
+	}
+	if _, err := path.Match(*lc.fUser, ""); err != nil {
+		return lc.usageErr("invalid -user pattern: %v", err)
+	}
+
+	// Requires real root credentials
+	client, err := lc.newGiteaClient(lc.rootCredentials())
+	check(err, "failed to create root client: %v", err)
+
+	now := time.Now()
+	var users []listedUser
+	forEachTemporaryUser(client, func(user *gitea.User) {
+		age := now.Sub(user.Created)
+		if age < *lc.fMinAge || (*lc.fMaxAge > 0 && age > *lc.fMaxAge) {
+			return
+		}
+		if *lc.fUser != "" {
+			if ok, _ := path.Match(*lc.fUser, user.UserName); !ok {
+				return
+			}
+		}
+		lu := listedUser{
+			User:    user.UserName,
+			Created: user.Created,
+			Age:     age.Round(time.Second).String(),
+			Repos:   []listedRepo{},
+		}
+		forEachUserRepo(client, user.UserName, func(repo *gitea.Repository) {
+			lr := listedRepo{
+				Name: repo.Name,
+				Size: repo.Size,
+			}
+			if !repo.Empty {
+				updated := repo.Updated
+				lr.LastPush = &updated
+			}
+			lu.Repos = append(lu.Repos, lr)
+		})
+		users = append(users, lu)
+	})
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Created.Before(users[j].Created)
+	})
+
+	if *lc.fFormat == "json" {
+		if users == nil {
+			users = []listedUser{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(users)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tAGE\tREPO\tSIZE\tLAST PUSH")
+	for _, u := range users {
+		if len(u.Repos) == 0 {
+			fmt.Fprintf(tw, "%v\t%v\t-\t-\t-\n", u.User, u.Age)
+			continue
+		}
+		for _, r := range u.Repos {
+			lastPush := "-"
+			if r.LastPush != nil {
+				lastPush = r.LastPush.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%vKiB\t%v\n", u.User, u.Age, r.Name, r.Size, lastPush)
+		}
+	}
+	return tw.Flush()
+}
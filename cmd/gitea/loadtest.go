@@ -0,0 +1,340 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	giteasdk "code.gitea.io/sdk/gitea"
+	"github.com/play-with-go/gitea"
+)
+
+// loadTestReport is the summary of a load test
+type loadTestReport struct {
+	// Requests is the number of requests made, of which Succeeded succeeded
+	// and Failed failed
+	Requests  int
+	Succeeded int
+	Failed    int
+
+	// Duration is the time from the start of the first request to the end
+	// of the last
+	Duration string
+
+	// Throughput is the number of successful requests per second
+	Throughput float64
+
+	// Latency holds percentiles of the latency of successful requests
+	Latency loadTestLatency
+
+	// Errors maps the class of each error, for example an HTTP status or
+	// timeout, to the number of requests that failed with it
+	Errors map[string]int
+
+	// Removed is the number of users removed per -cleanup. Users that
+	// could not be removed are counted in Errors as "cleanup failed".
+	Removed int
+}
+
+type loadTestLatency struct {
+	P50 string
+	P90 string
+	P95 string
+	P99 string
+	Max string
+}
+
+// loadTestResult is the outcome of a single request
+type loadTestResult struct {
+	latency time.Duration
+	user    string
+	err     error
+}
+
+func (lc *loadTestCmd) run(args []string) error {
+	if err := lc.fs.Parse(args); err != nil {
+		return lc.usageErr("failed to parse flags: %v", err)
+	}
+	if err := lc.config.applyFlags(lc.fs, "loadtest"); err != nil {
+		return lc.usageErr("%v", err)
+	}
+	if len(lc.fs.Args()) > 0 {
+		return lc.usageErr("loadtest does not take any arguments")
+	}
+	switch {
+	case *lc.fRequests < 0:
+		return lc.usageErr("-requests must not be negative")
+	case *lc.fRequests == 0 && *lc.fDuration == 0:
+		return lc.usageErr("one of -requests or -duration must be set")
+	case *lc.fRate < 0:
+		return lc.usageErr("-rate must not be negative")
+	case *lc.fConcurrency < 1:
+		return lc.usageErr("-concurrency must be at least 1")
+	}
+	switch *lc.fCleanup {
+	case "none", "release":
+	case "reap":
+		if *lc.fPattern == "" {
+			return lc.usageErr("-cleanup=reap requires -usernamePattern")
+		}
+	default:
+		return lc.usageErr("unknown -cleanup %q", *lc.fCleanup)
+	}
+	switch *lc.fFormat {
+	case "text", "json":
+	default:
+		return lc.usageErr("unknown -format %q", *lc.fFormat)
+	}
+
+	// An interrupt stops new requests from being started; those in flight
+	// complete so that their users can be cleaned up
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report, err := lc.loadTest(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *lc.fFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "requests\t%v\n", report.Requests)
+	fmt.Fprintf(tw, "succeeded\t%v\n", report.Succeeded)
+	fmt.Fprintf(tw, "failed\t%v\n", report.Failed)
+	fmt.Fprintf(tw, "duration\t%v\n", report.Duration)
+	fmt.Fprintf(tw, "throughput\t%.2f/s\n", report.Throughput)
+	fmt.Fprintf(tw, "latency\tp50 %v\tp90 %v\tp95 %v\tp99 %v\tmax %v\n", report.Latency.P50, report.Latency.P90, report.Latency.P95, report.Latency.P99, report.Latency.Max)
+	var classes []string
+	for c := range report.Errors {
+		classes = append(classes, c)
+	}
+	sort.Strings(classes)
+	for _, c := range classes {
+		fmt.Fprintf(tw, "error\t%v\t%v\n", report.Errors[c], c)
+	}
+	if *lc.fCleanup != "none" {
+		fmt.Fprintf(tw, "removed\t%v\n", report.Removed)
+	}
+	return tw.Flush()
+}
+
+// loadTest runs the load test configured by the flags of lc, stopping early
+// if ctx is cancelled, and cleans up afterwards
+func (lc *loadTestCmd) loadTest(ctx context.Context) (*loadTestReport, error) {
+	var spec gitea.NewUser
+	if *lc.fSpec != "" {
+		b, err := os.ReadFile(*lc.fSpec)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read -spec: %v", err)
+		}
+		if err := json.Unmarshal(b, &spec); err != nil {
+			return nil, fmt.Errorf("failed to decode -spec %v: %v", *lc.fSpec, err)
+		}
+	}
+	if *lc.fPattern != "" {
+		spec.UsernamePattern = *lc.fPattern
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = *lc.fConcurrency
+	client := gitea.NewClient(*lc.fURL,
+		gitea.WithHTTPClient(&http.Client{Transport: transport}),
+		gitea.WithTimeout(*lc.fTimeout),
+		gitea.WithRetries(0, 0),
+	)
+
+	if *lc.fDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *lc.fDuration)
+		defer cancel()
+	}
+	var tick <-chan time.Time
+	if *lc.fRate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / *lc.fRate))
+		defer t.Stop()
+		tick = t.C
+	}
+
+	lc.logger.Info("starting load test", "url", *lc.fURL, "requests", *lc.fRequests, "duration", *lc.fDuration, "rate", *lc.fRate, "concurrency", *lc.fConcurrency)
+	start := time.Now()
+	var mu sync.Mutex
+	var results []loadTestResult
+	var wg sync.WaitGroup
+	inFlight := make(chan struct{}, *lc.fConcurrency)
+requests:
+	for i := 0; *lc.fRequests == 0 || i < *lc.fRequests; i++ {
+		if tick != nil && i > 0 {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				break requests
+			}
+		}
+		select {
+		case inFlight <- struct{}{}:
+		case <-ctx.Done():
+			break requests
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+			// Requests are not made within ctx: once started, a request
+			// completes so that its user can be cleaned up
+			reqStart := time.Now()
+			sess, err := client.NewUser(context.Background(), spec)
+			res := loadTestResult{
+				latency: time.Since(reqStart),
+				err:     err,
+			}
+			if err == nil {
+				res.user = sess.Username
+			} else {
+				lc.logger.Debug("request failed", "err", err)
+			}
+			mu.Lock()
+			results = append(results, res)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	report := newLoadTestReport(results, time.Since(start))
+
+	if *lc.fCleanup != "none" {
+		// Requires real root credentials
+		gc, err := lc.newGiteaClient(lc.rootCredentials())
+		check(err, "failed to create root client: %v", err)
+		var users []string
+		switch *lc.fCleanup {
+		case "release":
+			for _, r := range results {
+				if r.err == nil {
+					users = append(users, r.user)
+				}
+			}
+		case "reap":
+			users = usersSince(gc, start, *lc.fPattern)
+		}
+		// A failure to remove one user does not prevent the removal of the
+		// others
+		ctx := withLogger(context.Background(), lc.logger)
+		for _, u := range users {
+			if err := deleteUser(ctx, gc, u); err != nil {
+				lc.logger.Error("failed to remove user", "user", u, "err", err)
+				report.Errors["cleanup failed"]++
+				continue
+			}
+			report.Removed++
+		}
+	}
+	return report, nil
+}
+
+// newLoadTestReport summarises results, the outcomes of requests made over
+// duration
+func newLoadTestReport(results []loadTestResult, duration time.Duration) *loadTestReport {
+	res := &loadTestReport{
+		Requests: len(results),
+		Duration: duration.Round(time.Millisecond).String(),
+		Errors:   make(map[string]int),
+	}
+	var latencies []time.Duration
+	for _, r := range results {
+		if r.err != nil {
+			res.Failed++
+			res.Errors[errorClass(r.err)]++
+			continue
+		}
+		res.Succeeded++
+		latencies = append(latencies, r.latency)
+	}
+	if duration > 0 {
+		res.Throughput = float64(res.Succeeded) / duration.Seconds()
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	res.Latency = loadTestLatency{
+		P50: percentile(latencies, 50),
+		P90: percentile(latencies, 90),
+		P95: percentile(latencies, 95),
+		P99: percentile(latencies, 99),
+		Max: percentile(latencies, 100),
+	}
+	return res
+}
+
+// percentile returns the pth percentile of the sorted latencies, by the
+// nearest-rank method, or - if there are none
+func percentile(latencies []time.Duration, p float64) string {
+	if len(latencies) == 0 {
+		return "-"
+	}
+	i := int(math.Ceil(p/100*float64(len(latencies)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return latencies[i].Round(time.Millisecond).String()
+}
+
+// errorClass returns the class of err by which errors are counted in a
+// loadTestReport
+func errorClass(err error) string {
+	var e *gitea.Error
+	if errors.As(err, &e) {
+		return fmt.Sprintf("%d %v", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout() {
+		return "timeout"
+	}
+	if errors.As(err, &ne) {
+		return "network error"
+	}
+	return "invalid response"
+}
+
+// usersSince returns the temporary users created at or after start whose
+// names match the UsernamePattern pattern, that is those created by requests
+// with that pattern
+func usersSince(client *giteasdk.Client, start time.Time, pattern string) []string {
+	// Gitea records the time of creation to the second
+	start = start.Truncate(time.Second)
+	var res []string
+	forEachTemporaryUser(client, func(user *giteasdk.User) {
+		if !user.Created.Before(start) && matchUsernamePattern(pattern, user.UserName) {
+			res = append(res, user.UserName)
+		}
+	})
+	return res
+}
+
+// matchUsernamePattern reports whether username could have been created from
+// the UsernamePattern pattern, in which an ID replaces the last "*", or is
+// appended if there is none
+func matchUsernamePattern(pattern, username string) bool {
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i != -1 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+	return len(username) > len(prefix)+len(suffix) &&
+		strings.HasPrefix(username, prefix) &&
+		strings.HasSuffix(username, suffix)
+}
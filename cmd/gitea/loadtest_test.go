@@ -0,0 +1,188 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/play-with-go/gitea"
+)
+
+// TestLoadTest runs load tests against a server backed by a fake Gitea
+// instance, cleaning up in each of the ways supported. Other users, such as
+// the participants of a workshop, must survive the cleanup.
+func TestLoadTest(t *testing.T) {
+	spec := filepath.Join(t.TempDir(), "spec.json")
+	b, err := json.Marshal(contractRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(spec, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, cleanup := range []string{"none", "release", "reap"} {
+		t.Run(cleanup, func(t *testing.T) {
+			fake := newFakeGitea(t)
+			gs := httptest.NewServer(fake)
+			defer gs.Close()
+			sc := newTestServeCmd(t, gs.URL)
+			if err := sc.fs.Set("usernamePrefixes", "loadtest-"); err != nil {
+				t.Fatal(err)
+			}
+			srv := httptest.NewServer(newTestServer(t, newTestProvisioner(sc)).handler())
+			defer srv.Close()
+
+			// A participant provisioned during the load test by another
+			// client of the same server
+			resp, err := http.Post(srv.URL+"/v2/newuser", "application/json", strings.NewReader(`{}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var participant gitea.Session
+			if err := json.NewDecoder(resp.Body).Decode(&participant); err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			lc := newLoadTestCmd(sc.runner)
+			err = lc.fs.Parse([]string{
+				"-url", srv.URL,
+				"-spec", spec,
+				"-requests", "12",
+				"-concurrency", "4",
+				"-rate", "200",
+				"-cleanup", cleanup,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := lc.loadTest(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Requests != 12 || report.Succeeded != 12 || report.Failed != 0 || len(report.Errors) != 0 {
+				t.Errorf("unexpected report: %+v", report)
+			}
+			if report.Latency.P50 == "-" || report.Latency.Max == "-" || report.Throughput <= 0 {
+				t.Errorf("unexpected latency or throughput in report: %+v", report)
+			}
+			users := fake.usernames()
+			switch cleanup {
+			case "none":
+				if len(users) != 13 || report.Removed != 0 {
+					t.Errorf("got users %v and %d removed; want 13 users and none removed", users, report.Removed)
+				}
+				for _, u := range users {
+					if u != participant.Username && !strings.HasPrefix(u, "loadtest-") {
+						t.Errorf("got user %v; want -usernamePattern to be used", u)
+					}
+				}
+			default:
+				if !reflect.DeepEqual(users, []string{participant.Username}) || report.Removed != 12 {
+					t.Errorf("got users %v and %d removed; want only %v and 12 removed", users, report.Removed, participant.Username)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadTestReport(t *testing.T) {
+	var results []loadTestResult
+	for i := 1; i <= 100; i++ {
+		results = append(results, loadTestResult{latency: time.Duration(i) * time.Millisecond})
+	}
+	results = append(results,
+		loadTestResult{err: &gitea.Error{StatusCode: http.StatusServiceUnavailable}},
+		loadTestResult{err: &gitea.Error{StatusCode: http.StatusServiceUnavailable}},
+		loadTestResult{err: context.DeadlineExceeded},
+	)
+	report := newLoadTestReport(results, 2*time.Second)
+	want := &loadTestReport{
+		Requests:   103,
+		Succeeded:  100,
+		Failed:     3,
+		Duration:   "2s",
+		Throughput: 50,
+		Latency: loadTestLatency{
+			P50: "50ms",
+			P90: "90ms",
+			P95: "95ms",
+			P99: "99ms",
+			Max: "100ms",
+		},
+		Errors: map[string]int{
+			"503 Service Unavailable": 2,
+			"timeout":                 1,
+		},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("got report %+v; want %+v", report, want)
+	}
+}
+
+// TestLoadTestCleanupFailure verifies that a failure to remove one user does
+// not prevent the removal of the others
+func TestLoadTestCleanupFailure(t *testing.T) {
+	fake := newFakeGitea(t)
+	var failed int32
+	gs := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method == "DELETE" && strings.HasPrefix(req.URL.Path, "/api/v1/admin/users/") && atomic.CompareAndSwapInt32(&failed, 0, 1) {
+			http.Error(resp, "boom", http.StatusInternalServerError)
+			return
+		}
+		fake.ServeHTTP(resp, req)
+	}))
+	defer gs.Close()
+	sc := newTestServeCmd(t, gs.URL)
+	if err := sc.fs.Set("usernamePrefixes", "loadtest-"); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newTestServer(t, newTestProvisioner(sc)).handler())
+	defer srv.Close()
+
+	lc := newLoadTestCmd(sc.runner)
+	if err := lc.fs.Parse([]string{"-url", srv.URL, "-requests", "5", "-cleanup", "reap"}); err != nil {
+		t.Fatal(err)
+	}
+	report, err := lc.loadTest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Succeeded != 5 || report.Removed != 4 || report.Errors["cleanup failed"] != 1 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	if users := fake.usernames(); len(users) != 1 {
+		t.Errorf("got users %v; want the one that failed to be removed", users)
+	}
+}
+
+func TestMatchUsernamePattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, username string
+		want              bool
+	}{
+		{"loadtest-*", "loadtest-0abc", true},
+		{"loadtest-*", "loadtest-", false},
+		{"loadtest-*", "u0abc", false},
+		{"loadtest-*-x", "loadtest-0abc-x", true},
+		{"loadtest-*-x", "loadtest-0abc", false},
+		{"loadtest", "loadtest0abc", true},
+		{"loadtest", "gophercon0abc", false},
+	} {
+		if got := matchUsernamePattern(tc.pattern, tc.username); got != tc.want {
+			t.Errorf("matchUsernamePattern(%q, %q) = %v; want %v", tc.pattern, tc.username, got, tc.want)
+		}
+	}
+}
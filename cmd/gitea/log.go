@@ -0,0 +1,135 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// headerRequestID is the header from which the ID of a request is taken, and
+// in which it is returned
+const headerRequestID = "X-Request-ID"
+
+// redacted replaces the value of sensitive log attributes
+const redacted = "REDACTED"
+
+// sensitiveKeys are substrings of the (lower case) attribute keys whose
+// values are never logged
+var sensitiveKeys = []string{
+	"password",
+	"passwd",
+	"token",
+	"secret",
+	"authorization",
+	"priv_key",
+	"privkey",
+	"private_key",
+
+	// Gitea returns the value of an access token in a field named sha1
+	"sha1",
+}
+
+// newLogger returns a logger that writes to w in the given format ("text" or
+// "json"), at debug level if debug is set. Sensitive values are redacted: see
+// redact.
+func newLogger(w io.Writer, format string, debug bool) (*slog.Logger, error) {
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+	opts := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redact,
+	}
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return slog.New(h), nil
+}
+
+// redact replaces the value of a with redacted if its key suggests it holds
+// a password, token or private key, or if its value contains a PEM-encoded
+// private key. Values other than strings, for example errors that echo a
+// request body, are checked by their string form.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if isSensitiveKey(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString, slog.KindAny:
+		if strings.Contains(a.Value.String(), "PRIVATE KEY") {
+			return slog.String(a.Key, redacted)
+		}
+	}
+	return a
+}
+
+// isSensitiveKey reports whether key, the key of a log attribute or the name
+// of a JSON field, suggests that its value is a password, token or private key
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+type loggerKey struct{}
+
+// withLogger returns a copy of ctx that carries l
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// logger returns the logger carried by ctx, or the default logger if there
+// is none
+func logger(ctx context.Context) *slog.Logger {
+	return loggerOr(ctx, slog.Default())
+}
+
+// loggerOr returns the logger carried by ctx, or def if there is none
+func loggerOr(ctx context.Context, def *slog.Logger) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return def
+}
+
+// requestID returns the ID of req: the value of its X-Request-ID header if
+// that is a reasonable ID, else a newly generated random ID
+func requestID(req *http.Request) string {
+	if id := req.Header.Get(headerRequestID); id != "" && len(id) <= 128 && isPrintableASCII(id) {
+		return id
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
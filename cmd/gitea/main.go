@@ -6,6 +6,8 @@
 package main
 
 import (
+	"log/slog"
+	"net/http"
 	"net/url"
 	"os"
 )
@@ -24,9 +26,18 @@ const (
 
 type runner struct {
 	*rootCmd
+	config            *config
 	serveCmd          *serveCmd
 	newContributorCmd *newContributorCmd
 	reapCmd           *reapCmd
+	auditCmd          *auditCmd
+	listCmd           *listCmd
+	loadTestCmd       *loadTestCmd
+	bootstrapCmd      *bootstrapCmd
+	contributorCmd    *contributorCmd
+
+	// audit is the audit log of serve or reap; nil if -auditLog is not set
+	audit *auditLog
 }
 
 func newRunner() *runner {
@@ -40,6 +51,37 @@ func (r *runner) mainerr() (err error) {
 		return usageErr{err, r.rootCmd}
 	}
 
+	// Apply environment variables before loading the configuration file,
+	// because -config can itself be set via $GITEA_CONFIG
+	if err := new(config).applyFlags(r.rootCmd.fs, ""); err != nil {
+		return r.rootCmd.usageErr("%v", err)
+	}
+	r.config, err = loadConfig(*r.fConfig)
+	check(err, "")
+	if err := r.config.applyFlags(r.rootCmd.fs, ""); err != nil {
+		return r.rootCmd.usageErr("%v", err)
+	}
+
+	r.logger, err = newLogger(os.Stderr, *r.fLogFormat, *r.fDebug)
+	if err != nil {
+		return r.rootCmd.usageErr("invalid -logFormat: %v", err)
+	}
+	slog.SetDefault(r.logger)
+
+	r.httpClient = new(http.Client)
+	if *r.fDebug {
+		t := &debugTransport{
+			next:   http.DefaultTransport,
+			logger: r.logger,
+		}
+		if *r.fDebugHTTP != "" {
+			f, err := os.OpenFile(*r.fDebugHTTP, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			check(err, "failed to open -debugHTTPFile: %v", err)
+			t.dump = f
+		}
+		r.httpClient.Transport = t
+	}
+
 	u, err := url.Parse(*r.fRootURL)
 	check(err, "failed to parse -rootURL value %q: %v", *r.fRootURL, err)
 	r.rootCmd.hostname = u.Hostname()
@@ -56,6 +98,16 @@ func (r *runner) mainerr() (err error) {
 		return r.reapCmd.run(args[1:])
 	case "newcontributor":
 		return r.newContributorCmd.run(args[1:])
+	case "contributor":
+		return r.contributorCmd.run(args[1:])
+	case "bootstrap":
+		return r.bootstrapCmd.run(args[1:])
+	case "list":
+		return r.listCmd.run(args[1:])
+	case "audit":
+		return r.auditCmd.run(args[1:])
+	case "loadtest":
+		return r.loadTestCmd.run(args[1:])
 	default:
 		return r.rootCmd.usageErr("unknown command: " + cmd)
 	}
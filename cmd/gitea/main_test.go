@@ -6,11 +6,9 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"os/exec"
 	"runtime"
@@ -18,9 +16,9 @@ import (
 	"testing"
 	"time"
 
-	"code.gitea.io/sdk/gitea"
+	giteasdk "code.gitea.io/sdk/gitea"
 	"github.com/kr/pretty"
-	"github.com/play-with-go/preguide"
+	"github.com/play-with-go/gitea"
 	"gopkg.in/retry.v1"
 )
 
@@ -30,15 +28,15 @@ import (
 // 1.  Start the docker-compose setup
 // 2.  Migrate
 // 3.  Create root user
-// 4.  Run cmd/gitea pre to create x org
-// 5.  Run cmd/gitea newcontributor to create a new contributor, extracting the token
-//     created as part of the setup
-// 6.  Stop the docker-compose setup
-// 7.  Restart the docker-compose setup, this time with the contributor credentials set
+// 4.  Run cmd/gitea bootstrap to create a contributor and the x org,
+//     extracting the contributor credentials it writes. Run it twice to check
+//     that it is idempotent
+// 5.  Stop the docker-compose setup
+// 6.  Restart the docker-compose setup, this time with the contributor credentials set
 //     so that the cmd_gitea prestep can use them
-// 8.  Call the cmd_gitea prestep to create a new user + repo
-// 9.  Decode to make sure we got the expected env vars
-// 10. Reap the user we just created
+// 7.  Call the cmd_gitea prestep to create a new user + repo
+// 8.  Decode to make sure we got the expected env vars
+// 9.  Reap the user we just created
 //
 // This whole setup is rather complicated by the fact that everything needs to
 // be run within docker-compose, but the test itself is invoked from outside
@@ -130,10 +128,21 @@ func TestEverything(t *testing.T) {
 		"--email", "blah@blah.com",
 	)
 
-	tokenJSON, _ := tr.mustRun(tr.self("newcontributor", "-email", "contributor@blah.com", "-fullname", "A Contributor", "-username", "testcontributor"))
-	var token gitea.AccessToken
-	err := json.Unmarshal(tokenJSON, &token)
-	check(err, "failed to decode token from %q: %v", tokenJSON, err)
+	bootstrap := func() map[string]string {
+		envOut, _ := tr.mustRun(tr.self("bootstrap", "-email", "contributor@blah.com", "-fullname", "A Contributor", "-username", "testcontributor", "-orgs", "x", "-envFile", "-"))
+		env := make(map[string]string)
+		for _, l := range strings.Split(strings.TrimSpace(string(envOut)), "\n") {
+			if i := strings.Index(l, "="); i > 0 {
+				env[l[:i]] = l[i+1:]
+			}
+		}
+		if env[EnvContributorUser] != "testcontributor" || env[EnvContributorPassword] == "" {
+			t.Fatalf("bootstrap did not output contributor credentials: %q", envOut)
+		}
+		return env
+	}
+	bootstrap()
+	contributor := bootstrap()
 
 	// Stop the docker-compose setup
 	tr.mustRunDockerCompose("down")
@@ -142,8 +151,8 @@ func TestEverything(t *testing.T) {
 	// including the contributor details
 	upContrib := tr.dockerComposeCmd("up", "-t", "0", "-d")
 	upContrib.Env = append(os.Environ(),
-		"PLAYWITHGODEV_CONTRIBUTOR_USER=newcontributor",
-		"PLAYWITHGODEV_CONTRIBUTOR_PASSWORD="+token.Token,
+		EnvContributorUser+"="+contributor[EnvContributorUser],
+		EnvContributorPassword+"="+contributor[EnvContributorPassword],
 	)
 	tr.mustRun(upContrib)
 	tr.dockerComposeLogToStd(t)
@@ -189,7 +198,7 @@ func waitErr() (err error) {
 		},
 	)
 	for a := retry.Start(strategy, nil); a.Next(); {
-		_, err := gitea.NewClient("http://gitea:3000")
+		_, err := giteasdk.NewClient("http://gitea:3000")
 		if err == nil {
 			break
 		}
@@ -199,44 +208,31 @@ func waitErr() (err error) {
 
 func prestepErr() (err error) {
 	defer handleKnown(&err)
-	args := strings.NewReader(`{"Repos": [{"Var": "REPO1", "Pattern": "user"},{"Var": "REPO2", "Pattern": "user*", "Private": true}]}`)
-	newuserURL := "http://cmd_gitea:8080/newuser"
-	resp, err := http.Post(newuserURL, "application/json", args)
-	check(err, "failed to post to %v: %v", newuserURL, err)
-	defer resp.Body.Close()
-	newuser, err := io.ReadAll(resp.Body)
-	check(err, "failed to read newuser response: %v", err)
-	if resp.StatusCode/100 != 2 {
-		raise("newuser request not successful with code %v: %s", resp.StatusCode, newuser)
-	}
-
-	dec := json.NewDecoder(bytes.NewBuffer(newuser))
-	var env preguide.PrestepOut
-	if err := dec.Decode(&env); err != nil {
-		raise("failed to decode env information: %v. Input was: %s", err, newuser)
-	}
-	found := make(map[string]*string)
-	for _, v := range env.Vars {
-		val := v[strings.Index(v, "=")+1:]
-		found[v[:strings.Index(v, "=")]] = &val
-	}
-	fail := false
-	for k, v := range found {
-		if v == nil {
-			fail = true
-			fmt.Fprintf(os.Stderr, "failed to find env var %v in %v", k, pretty.Sprint(env))
+	client := gitea.NewClient("http://cmd_gitea:8080")
+	sess, err := client.NewUser(context.Background(), gitea.NewUser{
+		Repos: []gitea.Repo{
+			{Var: "REPO1", Pattern: "user"},
+			{Var: "REPO2", Pattern: "user*", Private: true},
+		},
+	})
+	check(err, "newuser request failed: %v", err)
+	for k, v := range map[string]string{
+		"Username":   sess.Username,
+		"PrivateKey": sess.PrivateKey,
+		"PublicKey":  sess.PublicKey,
+		"KeyScan":    sess.KeyScan,
+	} {
+		if v == "" {
+			raise("session has empty %v: %v", k, pretty.Sprint(sess))
 		}
 	}
-	if fail {
-		raise("not all environment variables found")
-	}
 	// Verify that the patterns for both repo were respected
-	repo1 := fmt.Sprintf("random.com/%v/user", *found["GITEA_USERNAME"])
-	if *found["REPO1"] != repo1 {
-		raise("expected REPO1 to be %q; got %q", repo1, *found["REPO1"])
+	repo1 := fmt.Sprintf("random.com/%v/user", sess.Username)
+	if sess.Repos["REPO1"] != repo1 {
+		raise("expected REPO1 to be %q; got %q", repo1, sess.Repos["REPO1"])
 	}
-	if *found["REPO2"] == repo1 || !strings.HasPrefix(*found["REPO2"], repo1) {
-		raise("expected REPO2 to have prefix %q; got %q", repo1, *found["REPO2"])
+	if sess.Repos["REPO2"] == repo1 || !strings.HasPrefix(sess.Repos["REPO2"], repo1) {
+		raise("expected REPO2 to have prefix %q; got %q", repo1, sess.Repos["REPO2"])
 	}
 	// TODO: reinstate some sort of test here: github.com/play-with-go/gitea/issues/69
 	return nil
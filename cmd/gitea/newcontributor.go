@@ -6,17 +6,16 @@ package main
 
 import (
 	"crypto/rand"
-	"encoding/json"
 	"fmt"
-	"os"
-
-	"code.gitea.io/sdk/gitea"
 )
 
 func (ncc *newContributorCmd) run(args []string) error {
 	if err := ncc.fs.Parse(args); err != nil {
 		return ncc.usageErr("failed to parse flags: %v", err)
 	}
+	if err := ncc.config.applyFlags(ncc.fs, "newcontributor"); err != nil {
+		return ncc.usageErr("%v", err)
+	}
 
 	if *ncc.fEmail == "" {
 		raise("must supply a new contributor email address")
@@ -28,53 +27,20 @@ func (ncc *newContributorCmd) run(args []string) error {
 		raise("must supply a new contributor username")
 	}
 
+	switch *ncc.fFormat {
+	case "json", "env":
+	default:
+		return ncc.usageErr("unknown -format %q", *ncc.fFormat)
+	}
+
 	// Requires real root credentials
-	client, err := gitea.NewClient(*ncc.fRootURL)
+	client, err := ncc.newGiteaClient(ncc.rootCredentials())
 	check(err, "failed to create root client: %v", err)
-	client.SetBasicAuth(os.Getenv(EnvRootUser), os.Getenv(EnvRootPassword))
-
-	yes := true
-	no := false
-
-	password := randomPassword()
-
-	// Create the user
-	user, _, err := client.AdminCreateUser(gitea.CreateUserOption{
-		Email:              *ncc.fEmail,
-		FullName:           *ncc.fFullName,
-		LoginName:          *ncc.fUsername,
-		MustChangePassword: &no,
-		Password:           password,
-		SendNotify:         false,
-		Username:           *ncc.fUsername,
-		SourceID:           0,
-	})
-	check(err, "failed to create new contributor %v: %v", *ncc.fUsername, err)
-
-	// Set further user options
-	_, err = client.AdminEditUser(user.UserName, gitea.EditUserOption{
-		Admin:     &yes,
-		LoginName: user.UserName,
-		Email:     &user.Email,
-		FullName:  &user.FullName,
-		SourceID:  0,
-	})
-	check(err, "failed to edit contributor %v: %v", user.UserName, err)
-
-	// Create an access key as the user
-	userClient, err := gitea.NewClient(*ncc.fRootURL)
-	check(err, "failed to create user client: %v", err)
-	userClient.SetBasicAuth(user.UserName, password)
-
-	token, _, err := userClient.CreateAccessToken(gitea.CreateAccessTokenOption{
-		Name: "newcontributor-created access token",
-	})
-	check(err, "failed to create access token for %v: %v", user.UserName, err)
-	tokenAsJSON, err := json.Marshal(token)
-	check(err, "failed to JSON-marshal token: %v", err)
-	fmt.Printf("%s\n", tokenAsJSON)
 
-	return nil
+	// An existing user is reused, in which case the token is reissued
+	user := ncc.ensureContributor(client, *ncc.fUsername, *ncc.fEmail, *ncc.fFullName)
+	token := ncc.issueToken(user.UserName, "newcontributor-created access token")
+	return writeCredentials("-", *ncc.fFormat, user.UserName, token)
 }
 
 func randomPassword() string {
@@ -0,0 +1,26 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPI is the OpenAPI 3 document describing the routes of serve. It is
+// maintained by hand; TestOpenAPI verifies that it agrees with the routes and
+// the types of the requests and responses.
+//
+//go:embed openapi.json
+var openAPI []byte
+
+func serveOpenAPI(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(openAPI)
+}
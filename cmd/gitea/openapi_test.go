@@ -0,0 +1,379 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/play-with-go/gitea"
+	"github.com/play-with-go/preguide"
+)
+
+// openAPITypes maps the schemas of openapi.json to the Go types they
+// describe
+var openAPITypes = map[string]reflect.Type{
+	"NewUser":          reflect.TypeOf(gitea.NewUser{}),
+	"GoEnv":            reflect.TypeOf(gitea.GoEnv{}),
+	"Repo":             reflect.TypeOf(gitea.Repo{}),
+	"BranchProtection": reflect.TypeOf(gitea.BranchProtection{}),
+	"ProtectedTag":     reflect.TypeOf(gitea.ProtectedTag{}),
+	"RepoContent":      reflect.TypeOf(gitea.RepoContent{}),
+	"Label":            reflect.TypeOf(gitea.Label{}),
+	"Milestone":        reflect.TypeOf(gitea.Milestone{}),
+	"Branch":           reflect.TypeOf(gitea.Branch{}),
+	"File":             reflect.TypeOf(gitea.File{}),
+	"Issue":            reflect.TypeOf(gitea.Issue{}),
+	"PullRequest":      reflect.TypeOf(gitea.PullRequest{}),
+	"PrestepOut":       reflect.TypeOf(preguide.PrestepOut{}),
+	"Session":          reflect.TypeOf(gitea.Session{}),
+	"APIError":         reflect.TypeOf(apiError{}),
+	"Version":          reflect.TypeOf(versionDoc{}),
+	"Module":           reflect.TypeOf(debug.Module{}),
+	"BuildSetting":     reflect.TypeOf(debug.BuildSetting{}),
+}
+
+type openAPIDoc struct {
+	Paths      map[string]map[string]openAPIOperation
+	Components struct {
+		Responses map[string]openAPIResponse
+		Schemas   map[string]*openAPISchema
+	}
+}
+
+type openAPIOperation struct {
+	RequestBody struct {
+		Content map[string]struct {
+			Schema  *openAPISchema
+			Example json.RawMessage
+		}
+	}
+	Responses map[string]openAPIResponse
+}
+
+type openAPIResponse struct {
+	Ref     string `json:"$ref"`
+	Content map[string]struct {
+		Schema *openAPISchema
+	}
+}
+
+type openAPISchema struct {
+	Ref        string `json:"$ref"`
+	AllOf      []*openAPISchema
+	Type       string
+	Nullable   bool
+	Enum       []interface{}
+	Required   []string
+	Properties map[string]*openAPISchema
+	Items      *openAPISchema
+
+	AdditionalProperties *openAPISchema
+}
+
+func loadOpenAPI(t *testing.T) *openAPIDoc {
+	doc := new(openAPIDoc)
+	if err := json.Unmarshal(openAPI, doc); err != nil {
+		t.Fatalf("failed to decode openapi.json: %v", err)
+	}
+	return doc
+}
+
+// TestOpenAPI verifies that openapi.json documents exactly the routes of
+// serve, that its schemas agree with the Go types they describe, and that the
+// responses of the handlers conform to it.
+func TestOpenAPI(t *testing.T) {
+	doc := loadOpenAPI(t)
+	fake := httptest.NewServer(newFakeGitea(t))
+	defer fake.Close()
+	s := newTestServer(t, newTestProvisioner(newTestServeCmd(t, fake.URL)))
+
+	t.Run("Routes", func(t *testing.T) {
+		var got, want []string
+		for _, r := range s.routes() {
+			got = append(got, r.method+" "+r.path)
+		}
+		for p, ops := range doc.Paths {
+			for m := range ops {
+				want = append(want, strings.ToUpper(m)+" "+p)
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("routes %q; openapi.json documents %q", got, want)
+		}
+	})
+
+	t.Run("Schemas", func(t *testing.T) {
+		for name := range doc.Components.Schemas {
+			if _, ok := openAPITypes[name]; !ok {
+				t.Errorf("schema %v does not correspond to a Go type", name)
+			}
+		}
+		for name, typ := range openAPITypes {
+			schema, ok := doc.Components.Schemas[name]
+			if !ok {
+				t.Errorf("no schema for %v", typ)
+				continue
+			}
+			checkSchemaType(t, name, doc, schema, typ)
+		}
+	})
+
+	t.Run("Handlers", func(t *testing.T) {
+		srv := httptest.NewServer(s.handler())
+		defer srv.Close()
+
+		op := doc.Paths["/newuser"]["post"]
+		example := op.RequestBody.Content["application/json"].Example
+		dec := json.NewDecoder(bytes.NewReader(example))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(new(gitea.NewUser)); err != nil {
+			t.Errorf("example /newuser request does not decode as gitea.NewUser: %v", err)
+		}
+
+		for _, tc := range []struct {
+			method, path, op string
+			body             []byte
+			want             int
+		}{
+			{"GET", "/?get-version=1", "/", nil, http.StatusOK},
+			{"GET", "/", "/", nil, http.StatusBadRequest},
+			{"POST", "/newuser", "/newuser", example, http.StatusOK},
+			{"POST", "/newuser", "/newuser", []byte("{"), http.StatusBadRequest},
+			{"GET", "/openapi.json", "/openapi.json", nil, http.StatusOK},
+			{"GET", "/v1/version", "/v1/version", nil, http.StatusOK},
+			{"POST", "/v1/newuser", "/v1/newuser", example, http.StatusOK},
+			{"POST", "/v1/newuser", "/v1/newuser", []byte("{"), http.StatusBadRequest},
+			{"GET", "/v2/version", "/v2/version", nil, http.StatusOK},
+			{"POST", "/v2/newuser", "/v2/newuser", example, http.StatusOK},
+			{"POST", "/v2/newuser", "/v2/newuser", []byte("{"), http.StatusBadRequest},
+		} {
+			req, err := http.NewRequest(tc.method, srv.URL+tc.path, bytes.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			where := tc.method + " " + tc.path
+			if resp.StatusCode != tc.want {
+				t.Errorf("%v: got status %v; want %v: %s", where, resp.StatusCode, tc.want, body)
+				continue
+			}
+			checkResponse(t, where, doc, doc.Paths[tc.op][strings.ToLower(tc.method)], resp, body)
+		}
+	})
+}
+
+// resolve follows the $ref of schema, or that of its single allOf element
+func (doc *openAPIDoc) resolve(schema *openAPISchema) (name string, res *openAPISchema) {
+	if len(schema.AllOf) == 1 {
+		schema = schema.AllOf[0]
+	}
+	if schema.Ref == "" {
+		return "", schema
+	}
+	name = strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+	return name, doc.Components.Schemas[name]
+}
+
+// checkSchemaType verifies that schema describes the JSON encoding of typ
+func checkSchemaType(t *testing.T, where string, doc *openAPIDoc, schema *openAPISchema, typ reflect.Type) {
+	t.Helper()
+	if typ.Kind() == reflect.Ptr {
+		if !schema.Nullable {
+			t.Errorf("%v: %v is a pointer but is not nullable", where, typ)
+		}
+		typ = typ.Elem()
+	}
+	if name, res := doc.resolve(schema); name != "" {
+		if res == nil {
+			t.Errorf("%v: unknown schema %v", where, name)
+		} else if openAPITypes[name] != typ {
+			t.Errorf("%v: schema %v describes %v; want %v", where, name, openAPITypes[name], typ)
+		}
+		return
+	}
+	switch typ.Kind() {
+	case reflect.String:
+		checkSchemaKind(t, where, schema, "string")
+	case reflect.Bool:
+		checkSchemaKind(t, where, schema, "boolean")
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		checkSchemaKind(t, where, schema, "integer")
+	case reflect.Slice:
+		checkSchemaKind(t, where, schema, "array")
+		if schema.Items == nil {
+			t.Errorf("%v: array has no items", where)
+			return
+		}
+		checkSchemaType(t, where+"[]", doc, schema.Items, typ.Elem())
+	case reflect.Map:
+		checkSchemaKind(t, where, schema, "object")
+		if schema.AdditionalProperties == nil {
+			t.Errorf("%v: map has no additionalProperties", where)
+			return
+		}
+		checkSchemaType(t, where+"[]", doc, schema.AdditionalProperties, typ.Elem())
+	case reflect.Struct:
+		checkSchemaKind(t, where, schema, "object")
+		fields := make(map[string]bool)
+		for _, f := range jsonFields(typ) {
+			fields[f.Name] = true
+			p, ok := schema.Properties[f.Name]
+			if !ok {
+				t.Errorf("%v: no property for field %v.%v", where, typ, f.Name)
+				continue
+			}
+			checkSchemaType(t, where+"."+f.Name, doc, p, f.Type)
+		}
+		for p := range schema.Properties {
+			if !fields[p] {
+				t.Errorf("%v: property %v has no corresponding field in %v", where, p, typ)
+			}
+		}
+	default:
+		t.Errorf("%v: unsupported type %v", where, typ)
+	}
+}
+
+// jsonFields returns the fields of the struct type typ that are encoded as
+// JSON, including those promoted from embedded structs
+func jsonFields(typ reflect.Type) []reflect.StructField {
+	var res []reflect.StructField
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.Anonymous {
+			et := f.Type
+			if et.Kind() == reflect.Ptr {
+				et = et.Elem()
+			}
+			res = append(res, jsonFields(et)...)
+			continue
+		}
+		if f.IsExported() {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+func checkSchemaKind(t *testing.T, where string, schema *openAPISchema, kind string) {
+	t.Helper()
+	if schema.Type != kind {
+		t.Errorf("%v: got type %q; want %q", where, schema.Type, kind)
+	}
+}
+
+// checkResponse verifies that resp is documented as a response of op, and
+// that a JSON body conforms to the documented schema
+func checkResponse(t *testing.T, where string, doc *openAPIDoc, op openAPIOperation, resp *http.Response, body []byte) {
+	t.Helper()
+	r, ok := op.Responses[fmt.Sprint(resp.StatusCode)]
+	if !ok {
+		t.Errorf("%v: status %v is not documented", where, resp.StatusCode)
+		return
+	}
+	if r.Ref != "" {
+		r = doc.Components.Responses[strings.TrimPrefix(r.Ref, "#/components/responses/")]
+	}
+	ct := resp.Header.Get("Content-Type")
+	media, ok := r.Content["application/json"]
+	if !ok {
+		return
+	}
+	if !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("%v: got Content-Type %q; want application/json", where, ct)
+		return
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Errorf("%v: failed to decode response: %v", where, err)
+		return
+	}
+	for _, err := range doc.validate("response", media.Schema, v) {
+		t.Errorf("%v: %v", where, err)
+	}
+}
+
+// validate returns the ways in which the decoded JSON value v does not
+// conform to schema
+func (doc *openAPIDoc) validate(where string, schema *openAPISchema, v interface{}) []error {
+	nullable := schema.Nullable
+	_, schema = doc.resolve(schema)
+	if v == nil {
+		if nullable || schema.Nullable {
+			return nil
+		}
+		return []error{fmt.Errorf("%v: unexpected null", where)}
+	}
+	var errs []error
+	mismatch := func() []error {
+		return []error{fmt.Errorf("%v: got %T; want %v", where, v, schema.Type)}
+	}
+	switch schema.Type {
+	case "object":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		for _, r := range schema.Required {
+			if _, ok := m[r]; !ok {
+				errs = append(errs, fmt.Errorf("%v: missing required property %v", where, r))
+			}
+		}
+		for k, e := range m {
+			p, ok := schema.Properties[k]
+			if !ok && schema.AdditionalProperties != nil {
+				p, ok = schema.AdditionalProperties, true
+			}
+			if !ok {
+				if schema.Properties != nil {
+					errs = append(errs, fmt.Errorf("%v: undocumented property %v", where, k))
+				}
+				continue
+			}
+			errs = append(errs, doc.validate(where+"."+k, p, e)...)
+		}
+	case "array":
+		a, ok := v.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		for i, e := range a {
+			errs = append(errs, doc.validate(fmt.Sprintf("%v[%d]", where, i), schema.Items, e)...)
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return mismatch()
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return mismatch()
+		}
+	case "integer":
+		if f, ok := v.(float64); !ok || f != float64(int64(f)) {
+			return mismatch()
+		}
+	}
+	return errs
+}
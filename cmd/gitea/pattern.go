@@ -0,0 +1,98 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/play-with-go/gitea"
+)
+
+// patternEnv holds the values of the placeholders of a repository pattern
+// (see gitea.Repo.Pattern)
+type patternEnv struct {
+	user  string
+	guide string
+	date  string
+
+	// repos maps the Var of each repository of the request created so far
+	// to its name
+	repos map[string]string
+
+	newID func() string
+}
+
+func newPatternEnv(user, guide string, now time.Time, newID func() string) patternEnv {
+	return patternEnv{
+		user:  user,
+		guide: guide,
+		date:  now.UTC().Format("20060102"),
+		repos: make(map[string]string),
+		newID: newID,
+	}
+}
+
+// expandPattern returns the repository name given by pattern in env, and
+// whether it includes a unique ID, such that a name that already exists can
+// be retried with a different one
+func expandPattern(pattern string, env patternEnv) (name string, unique bool, err error) {
+	star := strings.LastIndex(pattern, "*")
+	var buf strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '*' && i == star:
+			buf.WriteString(env.newID())
+			unique = true
+		case c == '{':
+			j := strings.IndexByte(pattern[i:], '}')
+			if j == -1 {
+				return "", false, fmt.Errorf("unterminated placeholder in pattern %q", pattern)
+			}
+			ph := pattern[i+1 : i+j]
+			i += j
+			switch {
+			case ph == "id":
+				buf.WriteString(env.newID())
+				unique = true
+			case ph == "user":
+				buf.WriteString(env.user)
+			case ph == "guide":
+				if env.guide == "" {
+					return "", false, fmt.Errorf("pattern %q uses {guide} but the request does not specify a Guide", pattern)
+				}
+				buf.WriteString(env.guide)
+			case ph == "date":
+				buf.WriteString(env.date)
+			case strings.HasPrefix(ph, "var:"):
+				name, ok := env.repos[ph[len("var:"):]]
+				if !ok {
+					return "", false, fmt.Errorf("pattern %q refers to %v, which is not the Var of a preceding repository", pattern, ph[len("var:"):])
+				}
+				buf.WriteString(name)
+			default:
+				return "", false, fmt.Errorf("unknown placeholder {%v} in pattern %q", ph, pattern)
+			}
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String(), unique, nil
+}
+
+// checkRepoPatterns returns an error if the repository patterns of args are
+// invalid, expanding them with placeholder values
+func checkRepoPatterns(args *gitea.NewUser) error {
+	env := newPatternEnv("user", args.Guide, time.Now(), func() string { return "id" })
+	for _, r := range args.Repos {
+		name, _, err := expandPattern(r.Pattern, env)
+		if err != nil {
+			return err
+		}
+		env.repos[r.Var] = name
+	}
+	return nil
+}
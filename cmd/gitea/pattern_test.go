@@ -0,0 +1,80 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/play-with-go/gitea"
+)
+
+func TestExpandPattern(t *testing.T) {
+	now := time.Date(2024, time.June, 1, 23, 30, 0, 0, time.FixedZone("", -2*60*60))
+	for _, tc := range []struct {
+		pattern string
+		want    string
+		unique  bool
+		err     bool
+	}{
+		{pattern: "mod1", want: "mod1"},
+		{pattern: "*", want: "id1", unique: true},
+		{pattern: "mod*-a*b", want: "mod*-aid1b", unique: true},
+		{pattern: "{user}-hello-{id}", want: "u1-hello-id1", unique: true},
+		{pattern: "{id}-{id}", want: "id1-id2", unique: true},
+		{pattern: "{guide}-{date}", want: "go-modules-20240602"},
+		{pattern: "{var:REPO1}-pair", want: "mod1abc-pair"},
+		{pattern: "{var:REPO2}", err: true},
+		{pattern: "{name}", err: true},
+		{pattern: "{user", err: true},
+	} {
+		n := 0
+		env := newPatternEnv("u1", "go-modules", now, func() string {
+			n++
+			return fmt.Sprintf("id%d", n)
+		})
+		env.repos["REPO1"] = "mod1abc"
+		got, unique, err := expandPattern(tc.pattern, env)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: got %q; want error", tc.pattern, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.pattern, err)
+			continue
+		}
+		if got != tc.want || unique != tc.unique {
+			t.Errorf("%q: got %q, %v; want %q, %v", tc.pattern, got, unique, tc.want, tc.unique)
+		}
+	}
+}
+
+func TestCheckRepoPatterns(t *testing.T) {
+	valid := &gitea.NewUser{
+		Repos: []gitea.Repo{
+			{Var: "REPO1", Pattern: "{user}-hello-{id}"},
+			{Var: "REPO2", Pattern: "{var:REPO1}-test"},
+		},
+	}
+	if err := checkRepoPatterns(valid); err != nil {
+		t.Errorf("valid patterns: %v", err)
+	}
+	for _, args := range []*gitea.NewUser{
+		// {var:NAME} must refer to a preceding repository
+		{Repos: []gitea.Repo{
+			{Var: "REPO1", Pattern: "{var:REPO2}-test"},
+			{Var: "REPO2", Pattern: "*"},
+		}},
+		// {guide} requires a Guide
+		{Repos: []gitea.Repo{{Var: "REPO1", Pattern: "{guide}-*"}}},
+	} {
+		if err := checkRepoPatterns(args); err == nil {
+			t.Errorf("checkRepoPatterns(%+v) succeeded; want error", args.Repos)
+		}
+	}
+}
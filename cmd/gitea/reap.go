@@ -5,8 +5,8 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"os"
 	"time"
 
 	"code.gitea.io/sdk/gitea"
@@ -16,47 +16,87 @@ func (rc *reapCmd) run(args []string) error {
 	if err := rc.fs.Parse(args); err != nil {
 		return rc.usageErr("failed to parse flags: %v", err)
 	}
+	if err := rc.config.applyFlags(rc.fs, "reap"); err != nil {
+		return rc.usageErr("%v", err)
+	}
 
 	var err error
 
 	rc.now = time.Now()
 
+	rc.audit, err = openAuditLog(*rc.fAuditLog, "reap")
+	check(err, "failed to open audit log: %v", err)
+
 	rc.age, err = time.ParseDuration(*rc.fAge)
 	check(err, "failed to parse duration from %v: %v", *rc.fAge, err)
 
 	// Requires real root credentials
-	rc.client, err = gitea.NewClient(*rc.fRootURL)
+	rootUser, rootPassword := rc.rootCredentials()
+	rc.client, err = rc.newGiteaClient(rootUser, rootPassword)
 	check(err, "failed to create root client: %v", err)
-	rc.client.SetBasicAuth(os.Getenv(EnvRootUser), os.Getenv(EnvRootPassword))
 
-	rc.removeOldUsers()
+	rc.removeOldUsers(withAuditContext(context.Background(), "", rootUser))
 
 	return nil
 }
 
-func (rc *reapCmd) removeOldUsers() {
+func (rc *reapCmd) removeOldUsers(ctx context.Context) {
+	// List all users before deleting any: deleting as we page through them
+	// would move later users onto pages we have already visited
+	var users []*gitea.User
+	forEachTemporaryUser(rc.client, func(user *gitea.User) {
+		users = append(users, user)
+	})
+	for _, user := range users {
+		delta := rc.now.Sub(user.Created)
+		if delta < rc.age {
+			continue
+		}
+		// Remove all the user's repos first
+		rc.removeOldRepos(user)
+
+		_, err := rc.client.AdminDeleteUser(user.UserName)
+		check(err, "failed to delete user %v: %v", user.UserName, err)
+		rc.logger.Info("deleted user", "user", user.UserName, "age", delta)
+		rc.audit.record(ctx, auditEvent{Event: auditUserReaped, User: user.UserName, Reason: fmt.Sprintf("age %v", delta.Round(time.Second))})
+	}
+}
+
+func (rc *reapCmd) removeOldRepos(user *gitea.User) {
+	// As for users, list all repos before deleting any
+	var repos []*gitea.Repository
+	forEachUserRepo(rc.client, user.UserName, func(repo *gitea.Repository) {
+		repos = append(repos, repo)
+	})
+	for _, repo := range repos {
+		delta := rc.now.Sub(repo.Created)
+		if delta < rc.age {
+			continue
+		}
+		_, err := rc.client.DeleteRepo(user.UserName, repo.Name)
+		check(err, "failed to delete repo %v/%v: %v", user.UserName, repo.Name, err)
+		rc.logger.Info("deleted repo", "user", user.UserName, "repo", repo.Name, "age", delta)
+	}
+}
+
+// forEachTemporaryUser calls f for each temporary user, i.e. those created
+// by serve, paging through all users. Pages are numbered from 1: Gitea, and
+// the SDK, treat page 0 as page 1, which would otherwise be visited twice. f
+// must not delete users: see removeOldUsers.
+func forEachTemporaryUser(client *gitea.Client, f func(*gitea.User)) {
 	opt := gitea.AdminListUsersOptions{
 		ListOptions: gitea.ListOptions{
+			Page:     1,
 			PageSize: 10,
 		},
 	}
 	for {
-		users, _, err := rc.client.AdminListUsers(opt)
+		users, _, err := client.AdminListUsers(opt)
 		check(err, "failed to list users: %v", err)
 		for _, user := range users {
-			if user.FullName != TemporaryUserFullName {
-				continue
+			if user.FullName == TemporaryUserFullName {
+				f(user)
 			}
-			delta := rc.now.Sub(user.Created)
-			if delta < rc.age {
-				continue
-			}
-			// Remove all the user's repos first
-			rc.removeOldRepos(user)
-
-			_, err := rc.client.AdminDeleteUser(user.UserName)
-			check(err, "failed to delete user %v: %v", user.UserName, err)
-			fmt.Fprintf(os.Stderr, "deleted user %v (was %v old)\n", user.UserName, delta)
 		}
 		if len(users) < opt.PageSize {
 			break
@@ -65,23 +105,20 @@ func (rc *reapCmd) removeOldUsers() {
 	}
 }
 
-func (rc *reapCmd) removeOldRepos(user *gitea.User) {
+// forEachUserRepo calls f for each of the repositories of username, paging
+// through them. As for forEachTemporaryUser, f must not delete repos.
+func forEachUserRepo(client *gitea.Client, username string, f func(*gitea.Repository)) {
 	opt := gitea.ListReposOptions{
 		ListOptions: gitea.ListOptions{
+			Page:     1,
 			PageSize: 10,
 		},
 	}
 	for {
-		repos, _, err := rc.client.ListUserRepos(user.UserName, opt)
-		check(err, "failed to list repos via %v: %v", *rc.fRootURL, err)
+		repos, _, err := client.ListUserRepos(username, opt)
+		check(err, "failed to list repos of %v: %v", username, err)
 		for _, repo := range repos {
-			delta := rc.now.Sub(repo.Created)
-			if delta < rc.age {
-				continue
-			}
-			_, err := rc.client.DeleteRepo(user.UserName, repo.Name)
-			check(err, "failed to delete repo %v/%v: %v", user.UserName, repo.Name, err)
-			fmt.Fprintf(os.Stderr, "deleted repo %v/%v (was %v old)\n", user.UserName, repo.Name, delta)
+			f(repo)
 		}
 		if len(repos) < opt.PageSize {
 			break
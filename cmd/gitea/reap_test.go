@@ -0,0 +1,50 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestReap verifies that reap removes all old users, and their repos, when
+// there are several pages of each
+func TestReap(t *testing.T) {
+	fake := newFakeGitea(t)
+	gs := httptest.NewServer(fake)
+	defer gs.Close()
+
+	now := time.Now()
+	for i := 0; i < 25; i++ {
+		u := &fakeUser{created: now.Add(-4 * time.Hour)}
+		for j := 0; j < 25; j++ {
+			u.repos = append(u.repos, fmt.Sprintf("repo%02d", j))
+		}
+		fake.users[fmt.Sprintf("old%02d", i)] = u
+	}
+	fake.users["young"] = &fakeUser{created: now.Add(-time.Hour), repos: []string{"repo"}}
+
+	sc := newTestServeCmd(t, gs.URL)
+	rc := newReapCmd(sc.runner)
+	rc.now = now
+	rc.age = 3 * time.Hour
+	var err error
+	rc.client, err = rc.newGiteaClient("root", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.removeOldUsers(context.Background())
+
+	if got, want := fake.usernames(), []string{"young"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got users %v after reap; want %v", got, want)
+	}
+	if got := fake.users["young"].repos; len(got) != 1 {
+		t.Errorf("got repos %v for young user; want [repo]", got)
+	}
+}
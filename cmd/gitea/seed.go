@@ -0,0 +1,142 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	giteasdk "code.gitea.io/sdk/gitea"
+	"github.com/play-with-go/gitea"
+)
+
+// seedUserRepo creates the content declared in repoSpec within the newly
+// created repo. Labels and milestones are created first so that issues and
+// pull requests can refer to them by name.
+func (p *provisioner) seedUserRepo(ctx context.Context, user *userPassword, repo *giteasdk.Repository, repoSpec gitea.Repo) error {
+	content := repoSpec.Content
+	owner := user.UserName
+	log := logger(ctx).With("user", owner, "repo", repo.Name)
+	client, err := p.giteaClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	labels := make(map[string]int64)
+	for _, l := range content.Labels {
+		label, _, err := client.CreateLabel(owner, repo.Name, giteasdk.CreateLabelOption{
+			Name:        l.Name,
+			Color:       l.Color,
+			Description: l.Description,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create label %q in %v/%v: %v", l.Name, owner, repo.Name, err)
+		}
+		labels[l.Name] = label.ID
+		log.Debug("created label", "label", l.Name)
+	}
+
+	milestones := make(map[string]int64)
+	for _, m := range content.Milestones {
+		milestone, _, err := client.CreateMilestone(owner, repo.Name, giteasdk.CreateMilestoneOption{
+			Title:       m.Title,
+			Description: m.Description,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create milestone %q in %v/%v: %v", m.Title, owner, repo.Name, err)
+		}
+		milestones[m.Title] = milestone.ID
+		log.Debug("created milestone", "milestone", m.Title)
+	}
+
+	for _, b := range content.Branches {
+		from := b.From
+		if from == "" {
+			from = repo.DefaultBranch
+		}
+		_, _, err := client.CreateBranch(owner, repo.Name, giteasdk.CreateBranchOption{
+			BranchName:    b.Name,
+			OldBranchName: from,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create branch %v from %v in %v/%v: %v", b.Name, from, owner, repo.Name, err)
+		}
+		log.Debug("created branch", "branch", b.Name, "from", from)
+		for _, f := range b.Files {
+			_, _, err := client.CreateFile(owner, repo.Name, f.Path, giteasdk.CreateFileOptions{
+				FileOptions: giteasdk.FileOptions{
+					Message:    f.Message,
+					BranchName: b.Name,
+				},
+				Content: base64.StdEncoding.EncodeToString([]byte(f.Content)),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create file %v on branch %v in %v/%v: %v", f.Path, b.Name, owner, repo.Name, err)
+			}
+			log.Debug("created file", "branch", b.Name, "path", f.Path)
+		}
+	}
+
+	resolve := func(what string, labelNames []string, milestoneTitle string) (ls []int64, m int64, err error) {
+		for _, n := range labelNames {
+			id, ok := labels[n]
+			if !ok {
+				return nil, 0, fmt.Errorf("%v in %v/%v refers to unknown label %q", what, owner, repo.Name, n)
+			}
+			ls = append(ls, id)
+		}
+		if milestoneTitle != "" {
+			id, ok := milestones[milestoneTitle]
+			if !ok {
+				return nil, 0, fmt.Errorf("%v in %v/%v refers to unknown milestone %q", what, owner, repo.Name, milestoneTitle)
+			}
+			m = id
+		}
+		return
+	}
+
+	for _, i := range content.Issues {
+		ls, m, err := resolve("issue "+i.Title, i.Labels, i.Milestone)
+		if err != nil {
+			return err
+		}
+		_, _, err = client.CreateIssue(owner, repo.Name, giteasdk.CreateIssueOption{
+			Title:     i.Title,
+			Body:      i.Body,
+			Labels:    ls,
+			Milestone: m,
+			Closed:    i.Closed,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create issue %q in %v/%v: %v", i.Title, owner, repo.Name, err)
+		}
+		log.Debug("created issue", "title", i.Title)
+	}
+
+	for _, pr := range content.PullRequests {
+		base := pr.Base
+		if base == "" {
+			base = repo.DefaultBranch
+		}
+		ls, m, err := resolve("pull request "+pr.Title, pr.Labels, pr.Milestone)
+		if err != nil {
+			return err
+		}
+		_, _, err = client.CreatePullRequest(owner, repo.Name, giteasdk.CreatePullRequestOption{
+			Head:      pr.Head,
+			Base:      base,
+			Title:     pr.Title,
+			Body:      pr.Body,
+			Labels:    ls,
+			Milestone: m,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create pull request %q (%v -> %v) in %v/%v: %v", pr.Title, pr.Head, base, owner, repo.Name, err)
+		}
+		log.Debug("created pull request", "title", pr.Title, "head", pr.Head, "base", base)
+	}
+	return nil
+}
@@ -9,208 +9,910 @@ import (
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
-	"encoding/binary"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"io"
+	"log/slog"
 	mathrand "math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"regexp"
 	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	giteasdk "code.gitea.io/sdk/gitea"
 	"github.com/play-with-go/gitea"
 	"github.com/play-with-go/preguide"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/retry.v1"
 )
 
 func (sc *serveCmd) run(args []string) error {
-	if len(args) > 0 {
-		raise("serve does not take any flags or arguments")
+	if err := sc.fs.Parse(args); err != nil {
+		return sc.usageErr("failed to parse flags: %v", err)
 	}
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals)
+	if err := sc.config.applyFlags(sc.fs, "serve"); err != nil {
+		return sc.usageErr("%v", err)
+	}
+	if (*sc.fTLSCert == "") != (*sc.fTLSKey == "") {
+		return sc.usageErr("-tlsCert and -tlsKey must be specified together")
+	}
+	if *sc.fTLSClientCA != "" && *sc.fTLSCert == "" {
+		return sc.usageErr("-tlsClientCA requires -tlsCert and -tlsKey")
+	}
+	if len(sc.fs.Args()) > 0 {
+		raise("serve does not take any arguments")
+	}
+	if err := sc.setupIDs(); err != nil {
+		return sc.usageErr("%v", err)
+	}
+
+	var err error
+	sc.audit, err = openAuditLog(*sc.fAuditLog, "serve")
+	check(err, "failed to open audit log: %v", err)
+
+	if *sc.fStateFile != "" {
+		sc.store, err = openStore(*sc.fStateFile)
+		check(err, "failed to open state store: %v", err)
+		defer sc.store.close()
+	}
+
+	if *sc.fOTLPEndpoint != "" {
+		shutdown, err := sc.setupTracing(context.Background(), *sc.fOTLPEndpoint)
+		check(err, "failed to set up tracing: %v", err)
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(ctx); err != nil {
+				sc.logger.Error("failed to flush traces", "err", err)
+			}
+		}()
+	}
+
+	// background is cancelled as soon as we start to shut down, stopping the
+	// creation of the client and the keyscan if they are still running.
+	// provisioning is only cancelled if in-flight requests fail to complete
+	// within the shutdown timeout, at which point they roll back.
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	provisioning, abandonProvisioning := context.WithCancel(context.Background())
+	defer abandonProvisioning()
+
+	s := sc.newServer(background, provisioning)
+	go s.init()
+
+	addr := fmt.Sprintf(":%v", *sc.fPort)
 
+	// Requests are traced (a no-op unless -otlpEndpoint is set), continuing
+	// any trace started by the caller per the W3C trace context headers
+	srv := &http.Server{
+		Handler: otelhttp.NewHandler(s.handler(), "serve",
+			otelhttp.WithSpanNameFormatter(func(_ string, req *http.Request) string {
+				return req.Method + " " + req.URL.Path
+			}),
+		),
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	scheme := "http"
+	if *sc.fTLSCert != "" {
+		tr, err := newTLSReloader(sc.logger, *sc.fTLSCert, *sc.fTLSKey, *sc.fTLSClientCA)
+		check(err, "failed to configure TLS: %v", err)
+		l = tls.NewListener(l, tr.tlsConfig())
+		scheme = "https"
+	}
+
+	errors := make(chan error)
+	go func() {
+		defer close(errors)
+		sigint := make(chan os.Signal, 1)
+		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
+		var initErr error
+		select {
+		case sig := <-sigint:
+			sc.logger.Info("shutting down", "signal", sig.String(), "timeout", *sc.fShutdownTimeout)
+		case <-s.failed:
+			initErr = s.initErr
+			sc.logger.Error("shutting down: failed to initialise", "err", initErr)
+		}
+		signal.Stop(sigint)
+		stopBackground()
+
+		// Stop accepting new connections and wait for in-flight requests to
+		// complete. If they do not do so in time, abandon them, causing them
+		// to roll back, and wait for the roll back to complete.
+		ctx, cancel := context.WithTimeout(context.Background(), *sc.fShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			sc.logger.Warn("in-flight requests did not complete in time; rolling back")
+			abandonProvisioning()
+			s.inFlight.Wait()
+		}
+		if n := atomic.LoadInt32(&s.abandoned); n > 0 {
+			errors <- fmt.Errorf("HTTP server shutdown failed: abandoned %d in-flight request(s)", n)
+		} else if initErr != nil {
+			errors <- fmt.Errorf("failed to initialise: %v", initErr)
+		}
+	}()
+	sc.logger.Info("listening", "addr", addr, "scheme", scheme)
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		raise("HTTP server failed: %v", err)
+	}
+	if err := <-errors; err != nil {
+		raise("%v", err)
+	}
+	return nil
+}
+
+// versionDoc is the version document reported to consumers. preguide
+// considers the output of a guide stale when any part of it changes.
+type versionDoc struct {
+	// BuildInfo is the build information of this binary
+	*debug.BuildInfo
+
+	// GiteaVersion is the version of the Gitea server
+	GiteaVersion string
+
+	// KeyScan is the SHA256 fingerprint of the host keys in the keyscan of
+	// the Gitea instance. The keyscan itself changes on each run because
+	// hostnames are hashed with a random salt.
+	KeyScan string
+
+	// Config is a SHA256 hash of the configuration of serve that affects
+	// the response to a /newuser request: see configFlags
+	Config string
+}
+
+// versionJSON returns the version document
+func (p *provisioner) versionJSON() ([]byte, error) {
 	buildInfo, ok := debug.ReadBuildInfo()
 	if !ok {
-		raise("failed to get debug build info")
+		return nil, fmt.Errorf("failed to get debug build info")
 	}
 	// The build settings for this endpoint are not relevant
 	// information for the version we report to consumers.
 	// Zero them out
 	buildInfo.Settings = nil
-	buildInfoJSON, err := json.MarshalIndent(buildInfo, "", "  ")
-	check(err, "failed to JSON marshal build info: %v", err)
+	keyScan, err := keyScanFingerprint(p.keyScan)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(versionDoc{
+		BuildInfo:    buildInfo,
+		GiteaVersion: p.giteaVersion,
+		KeyScan:      keyScan,
+		Config:       p.configHash(),
+	}, "", "  ")
+}
+
+// keyScanFingerprint returns the SHA256 fingerprints of the keys in the
+// known_hosts format keyScan, sorted and comma-separated
+func keyScanFingerprint(keyScan string) (string, error) {
+	var res []string
+	for rest := []byte(keyScan); len(rest) > 0; {
+		var key ssh.PublicKey
+		var err error
+		_, _, key, _, rest, err = ssh.ParseKnownHosts(rest)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to parse keyscan: %v", err)
+		}
+		res = append(res, ssh.FingerprintSHA256(key))
+	}
+	sort.Strings(res)
+	return strings.Join(res, ","), nil
+}
+
+// configFlags are the flags of serve and the root command that affect the
+// response to a /newuser request, and so are hashed by configHash. Flags that
+// are purely operational, for example -debug or -tlsCert, are not included,
+// so that changing them does not invalidate the output cached by guides.
+var configFlags = []string{
+	"rootURL",
+	"idFormat",
+	"idPrefix",
+	"idLength",
+	"idAlphabet",
+	"usernamePrefixes",
+}
 
-	clientCreate := make(chan int)
+// configHash returns a hash of the values of configFlags, which reflect the
+// configuration file and environment
+func (sc *serveCmd) configHash() string {
+	h := sha256.New()
+	for _, name := range configFlags {
+		f := sc.fs.Lookup(name)
+		if f == nil {
+			f = sc.rootCmd.fs.Lookup(name)
+		}
+		fmt.Fprintf(h, "%v=%q\n", name, f.Value.String())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// server holds the state shared by the handlers of serve
+type server struct {
+	sc *serveCmd
+
+	// background and provisioning are as described in serveCmd.run
+	background   context.Context
+	provisioning context.Context
+
+	// initialised is closed once init has found the properties of the Gitea
+	// instance and reconciled the store, at which point either p or, in case
+	// of failure, initErr is set. Neither changes thereafter, hence handlers may read them without
+	// synchronisation once initialised is closed. failed is also closed if
+	// init fails, at which point serve shuts down.
+	initialised chan int
+	failed      chan int
+	p           *provisioner
+	initErr     error
+
+	// inFlight tracks the /newuser requests being handled; abandoned counts
+	// those that were rolled back because they did not complete in time
+	inFlight  sync.WaitGroup
+	abandoned int32
+
+	// versionOnce guards versionJSON and versionErr, the version document
+	// once it can be determined
+	versionOnce sync.Once
+	versionJSON []byte
+	versionErr  error
+
+	// idempotency holds the responses to /newuser requests made with an
+	// idempotency key; nil if -idempotencyWindow is zero
+	idempotency *idempotencyCache
+}
+
+func (sc *serveCmd) newServer(background, provisioning context.Context) *server {
+	s := &server{
+		sc:           sc,
+		background:   background,
+		provisioning: provisioning,
+		initialised:  make(chan int),
+		failed:       make(chan int),
+	}
+	if *sc.fIdempotencyWindow > 0 {
+		s.idempotency = newIdempotencyCache(*sc.fIdempotencyWindow)
+	}
+	return s
+}
+
+// init finds the version of the Gitea server and its keyscan concurrently,
+// creates the provisioner that depends on them, and then reconciles the
+// store, if any, before requests are handled. It stops early if the server starts to shut down. If it
+// fails, it closes s.failed: serve cannot handle requests without the
+// properties of the Gitea instance, so it exits, to be restarted.
+func (s *server) init() {
+	sc := s.sc
+	var wg sync.WaitGroup
+	var version, keyScan string
+	var versionErr, keyScanErr error
+	wg.Add(2)
 	go func() {
-		strategy := retry.LimitTime(5*time.Second,
-			retry.Exponential{
-				Initial: 100 * time.Millisecond,
-				Factor:  1.5,
-			},
-		)
-		for a := retry.Start(strategy, nil); a.Next(); {
-			fmt.Printf("Connecting to %v\n", *sc.fRootURL)
-			sc.client, err = giteasdk.NewClient(*sc.fRootURL)
-			if err == nil {
-				break
-			}
+		defer wg.Done()
+		version, versionErr = sc.connect(s.background)
+		if versionErr != nil {
+			sc.logger.Error("failed to create client", "err", versionErr)
 		}
-		check(err, "failed to create root client: %v", err)
-		sc.client.SetBasicAuth(os.Getenv(EnvContributorUser), os.Getenv(EnvContributorPassword))
-		close(clientCreate)
 	}()
-
-	keyScanComplete := make(chan int)
 	go func() {
-		sc.runKeyScan()
-		close(keyScanComplete)
+		defer wg.Done()
+		keyScan, keyScanErr = sc.keyScan(s.background)
+		if keyScanErr != nil {
+			sc.logger.Error("keyscan failed", "err", keyScanErr)
+		}
 	}()
+	wg.Wait()
+	if s.initErr = versionErr; s.initErr == nil {
+		s.initErr = keyScanErr
+	}
+	if s.initErr == nil {
+		s.p = sc.newProvisioner(version, keyScan)
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(resp http.ResponseWriter, req *http.Request) {
-		if req.URL.Query().Get("get-version") != "1" || req.Method != "GET" {
-			resp.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		fmt.Fprintf(resp, "%s", buildInfoJSON)
-	})
-	mux.HandleFunc("/newuser", func(resp http.ResponseWriter, req *http.Request) {
-		<-clientCreate
-		<-keyScanComplete
-		// Requires contriburo credentials
-		if req.Method != "POST" {
-			resp.WriteHeader(http.StatusBadRequest)
-			return
+		// Reconcile before handling any requests: users and sessions created
+		// while reconcile runs would otherwise be missing from its view of
+		// Gitea or of the store, and so be removed or adopted twice. Drift is
+		// repaired on a best-effort basis: a failure to reconcile does not
+		// prevent us from serving requests.
+		if sc.store != nil {
+			if err := s.p.reconcile(withLogger(s.background, sc.logger)); err != nil {
+				sc.logger.Error("failed to reconcile state with Gitea", "err", err)
+			}
 		}
-		args := new(gitea.NewUser)
-		dec := json.NewDecoder(req.Body)
-		if err := dec.Decode(&args); err != nil {
-			resp.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(resp, "failed to decode request: %v", err)
-			return
+	}
+	close(s.initialised)
+	if s.initErr != nil {
+		close(s.failed)
+	}
+}
+
+// connect connects to Gitea as the contributor, retrying for a short while,
+// and returns the version of the server
+func (sc *serveCmd) connect(ctx context.Context) (string, error) {
+	strategy := retry.LimitTime(5*time.Second,
+		retry.Exponential{
+			Initial: 100 * time.Millisecond,
+			Factor:  1.5,
+		},
+	)
+	var err error
+	for a := retry.StartWithCancel(strategy, nil, ctx.Done()); a.Next(); {
+		sc.logger.Info("connecting to Gitea", "url", *sc.fRootURL)
+		var client *giteasdk.Client
+		client, err = sc.newGiteaClient(sc.contributorCredentials())
+		if err == nil {
+			var version string
+			version, _, err = client.ServerVersion()
+			if err == nil {
+				return version, nil
+			}
 		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return "", fmt.Errorf("failed to create root client: %v", err)
+}
 
-		res := sc.newUser(args)
+// ready waits for init to find the properties of the Gitea instance,
+// returning the provisioner. If init fails, or the server shuts down first,
+// it returns the error to report with an HTTP status code.
+func (s *server) ready() (p *provisioner, status int, err error) {
+	select {
+	case <-s.initialised:
+	case <-s.background.Done():
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("server is shutting down")
+	}
+	if s.initErr != nil {
+		return nil, http.StatusServiceUnavailable, s.initErr
+	}
+	return s.p, http.StatusOK, nil
+}
+
+// route is an endpoint of serve
+type route struct {
+	method  string
+	path    string
+	handler http.HandlerFunc
+}
+
+// routes returns the endpoints of serve, each of which is documented in
+// openapi.json.
+//
+// All versions accept the same gitea.NewUser request, including fields added
+// after /v1, because preguide uses /newuser. Such fields must be optional,
+// with a zero value that preserves the existing behaviour. The versions
+// differ only in how they encode responses and errors: /v1 returns a
+// preguide.PrestepOut and plain text errors, /v2 a gitea.Session and JSON
+// errors. It is the /v1 encoding that is frozen, so that guides written
+// against it continue to work unchanged. The unversioned routes predate
+// versioning and are aliases for their /v1 equivalents.
+func (s *server) routes() []route {
+	return []route{
+		{"GET", "/", s.serveLegacyVersion},
+		{"POST", "/newuser", s.idempotent(s.serveNewUserV1, writeErrorV1)},
+		{"GET", "/openapi.json", serveOpenAPI},
 
-		enc := json.NewEncoder(resp)
-		if err := enc.Encode(res); err != nil {
-			// TODO: this header write is probably too late?
-			resp.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(resp, "failed to encode response: %v", err)
+		{"GET", "/v1/version", s.serveVersion},
+		{"POST", "/v1/newuser", s.idempotent(s.serveNewUserV1, writeErrorV1)},
+
+		{"GET", "/v2/version", s.serveVersion},
+		{"POST", "/v2/newuser", s.idempotent(s.serveNewUserV2, writeErrorV2)},
+	}
+}
+
+// handler returns the handler for all the routes of s
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	for _, r := range s.routes() {
+		mux.HandleFunc(r.path, r.handler)
+	}
+	return mux
+}
+
+// serveLegacyVersion serves the version document at /?get-version=1, as
+// used by preguide. The / route otherwise matches all unknown paths, which
+// are bad requests.
+func (s *server) serveLegacyVersion(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Query().Get("get-version") != "1" {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.serveVersion(resp, req)
+}
+
+// serveVersion serves the version document, once the Gitea version and
+// keyscan on which it depends are known
+func (s *server) serveVersion(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	p, status, err := s.ready()
+	if err != nil {
+		resp.WriteHeader(status)
+		fmt.Fprintf(resp, "%v", err)
+		return
+	}
+	s.versionOnce.Do(func() {
+		s.versionJSON, s.versionErr = p.versionJSON()
+	})
+	if s.versionErr != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(resp, "failed to build version document: %v", s.versionErr)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(resp, "%s", s.versionJSON)
+}
+
+// apiError is the body of an error response from a /v2 route
+type apiError struct {
+	// Error is the error message
+	Error string
+
+	// RequestID is the ID of the request, for correlation with the server
+	// logs
+	RequestID string
+}
+
+// serveNewUserV1 serves a /v1/newuser request. The response is a
+// preguide.PrestepOut; errors are reported as plain text.
+func (s *server) serveNewUserV1(resp http.ResponseWriter, req *http.Request) {
+	_, res, status, err := s.handleNewUser(resp, req)
+	if err != nil {
+		writeErrorV1(resp, status, err)
+		return
+	}
+	writeJSON(resp, http.StatusOK, res)
+}
+
+// writeErrorV1 writes err as the plain text body of a /v1 error response
+// with the given status
+func writeErrorV1(resp http.ResponseWriter, status int, err error) {
+	resp.WriteHeader(status)
+	fmt.Fprintf(resp, "%v", err)
+}
+
+// serveNewUserV2 serves a /v2/newuser request. The response is a
+// gitea.Session; errors are reported as an apiError.
+func (s *server) serveNewUserV2(resp http.ResponseWriter, req *http.Request) {
+	args, res, status, err := s.handleNewUser(resp, req)
+	if err == nil {
+		var sess *gitea.Session
+		sess, err = gitea.ParseSession(*args, res.Vars)
+		if err == nil {
+			writeJSON(resp, http.StatusOK, sess)
 			return
 		}
-	})
+		status = http.StatusInternalServerError
+	}
+	writeErrorV2(resp, status, err)
+}
 
-	addr := fmt.Sprintf(":%v", *sc.fPort)
+// writeErrorV2 writes err as the apiError body of a /v2 error response with
+// the given status
+func writeErrorV2(resp http.ResponseWriter, status int, err error) {
+	writeJSON(resp, status, apiError{
+		Error:     err.Error(),
+		RequestID: resp.Header().Get(headerRequestID),
+	})
+}
 
-	srv := &http.Server{
-		Handler: mux,
+// writeJSON writes v as the JSON body of a response with the given status
+func writeJSON(resp http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(resp, "failed to encode response: %v", err)
+		return
 	}
-	l, err := net.Listen("tcp", addr)
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	resp.Write(append(b, '\n'))
+}
+
+// handleNewUser handles a request for a new user common to all versions of
+// the API, returning the decoded request and the result. If the request
+// fails, the returned error is the message to report, with the HTTP status
+// code.
+func (s *server) handleNewUser(resp http.ResponseWriter, req *http.Request) (args *gitea.NewUser, res preguide.PrestepOut, status int, err error) {
+	sc := s.sc
+	s.inFlight.Add(1)
+	defer s.inFlight.Done()
+	id := requestID(req)
+	resp.Header().Set(headerRequestID, id)
+	log := s.requestLogger(req, id)
+	span := trace.SpanFromContext(req.Context())
+	p, status, err := s.ready()
 	if err != nil {
-		panic(err)
+		return nil, res, status, err
+	}
+	// Requires contriburo credentials
+	if req.Method != "POST" {
+		return nil, res, http.StatusBadRequest, fmt.Errorf("method must be POST")
+	}
+	args = new(gitea.NewUser)
+	dec := json.NewDecoder(req.Body)
+	if err := dec.Decode(&args); err != nil {
+		return nil, res, http.StatusBadRequest, fmt.Errorf("failed to decode request: %v", err)
+	}
+	if err := sc.checkUsernamePattern(args.UsernamePattern); err != nil {
+		return nil, res, http.StatusBadRequest, err
+	}
+	if err := checkRepoPatterns(args); err != nil {
+		return nil, res, http.StatusBadRequest, err
+	}
+	if err := p.checkRepoProtections(args); err != nil {
+		return nil, res, http.StatusBadRequest, err
 	}
 
-	errors := make(chan error)
-	go func() {
-		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
-		<-sigint
-		if err := srv.Shutdown(context.Background()); err != nil {
-			errors <- err
+	log.Info("new user requested", "repos", len(args.Repos))
+	start := time.Now()
+	ctx := trace.ContextWithSpan(withLogger(s.provisioning, log), span)
+	ctx = withAuditContext(ctx, id, requestCaller(req))
+	res, err = p.newUser(ctx, args)
+	if err != nil {
+		if s.provisioning.Err() != nil {
+			atomic.AddInt32(&s.abandoned, 1)
 		}
-		close(errors)
-	}()
-	fmt.Fprintf(os.Stderr, "Listening on %v\n", addr)
-	if err := srv.Serve(l); err != http.ErrServerClosed {
-		raise("HTTP server failed: %v", err)
+		log.Error("failed to create user", "err", err, "duration", time.Since(start))
+		return nil, res, http.StatusInternalServerError, fmt.Errorf("failed to create user: %v", err)
 	}
-	if err := <-errors; err != nil {
-		raise("HTTP server shutdown failed: %v", err)
+	log.Info("new user created", "duration", time.Since(start))
+	return args, res, http.StatusOK, nil
+}
+
+// requestLogger returns the logger for req, with ID id, which attributes log
+// lines to the request and its trace
+func (s *server) requestLogger(req *http.Request, id string) *slog.Logger {
+	log := s.sc.logger.With("request_id", id)
+	if sctx := trace.SpanContextFromContext(req.Context()); sctx.IsValid() {
+		log = log.With("trace_id", sctx.TraceID().String())
+	}
+	return log
+}
+
+// provisioner provisions users on behalf of serve. In addition to the
+// configuration of serve, it holds the properties of the Gitea instance found
+// when serve starts. None of its state changes once it has been created, and
+// the state of each request is local to the calls that handle it, hence it is
+// safe for concurrent use.
+type provisioner struct {
+	*serveCmd
+
+	// giteaVersion is the version of the Gitea server
+	giteaVersion string
+
+	// keyScan is the ssh-keyscan output for the Gitea instance
+	keyScan string
+}
+
+func (sc *serveCmd) newProvisioner(giteaVersion, keyScan string) *provisioner {
+	return &provisioner{
+		serveCmd:     sc,
+		giteaVersion: giteaVersion,
+		keyScan:      keyScan,
 	}
-	return nil
 }
 
-func (sc *serveCmd) newUser(args *gitea.NewUser) preguide.PrestepOut {
+func (p *provisioner) newUser(ctx context.Context, args *gitea.NewUser) (res preguide.PrestepOut, err error) {
+	ctx, span := tracer.Start(ctx, "newUser")
+	defer endSpan(span, &err)
+	var user *userPassword
+	defer func() {
+		if err != nil && user != nil {
+			logger(ctx).Warn("rolling back user", "user", user.UserName)
+			// Roll back even if provisioning was abandoned because ctx
+			// was cancelled
+			if rerr := p.removeUser(context.WithoutCancel(ctx), user.UserName, "rollback"); rerr != nil {
+				err = fmt.Errorf("%v; failed to roll back user %v: %v", err, user.UserName, rerr)
+			}
+		}
+	}()
+
 	// User account -> username (gitea)
-	user := sc.createUser()
+	user, err = p.createUser(ctx, args.UsernamePattern)
+	if err != nil {
+		return res, err
+	}
+	if err := abandonedErr(ctx); err != nil {
+		return res, err
+	}
 
-	priv, pub := sc.createUserSSHKey()
+	priv, pub, err := p.createUserSSHKey(ctx)
+	if err != nil {
+		return res, err
+	}
 
 	// ssh-key (upload to gitea)
-	sc.setUserSSHKey(user, pub)
+	fingerprint, err := p.setUserSSHKey(ctx, user, pub)
+	if err != nil {
+		return res, err
+	}
+	if err := abandonedErr(ctx); err != nil {
+		return res, err
+	}
 
 	// Create gitea repositories in userguides
-	repos := sc.createUserRepos(user, args.Repos)
+	repos, err := p.createUserRepos(ctx, user, args)
+	if err != nil {
+		return res, err
+	}
 
-	res := preguide.PrestepOut{
+	if p.store != nil {
+		if err := p.recordSession(ctx, user, repos, fingerprint); err != nil {
+			return res, err
+		}
+	}
+
+	res = preguide.PrestepOut{
 		Vars: []string{
 			"GITEA_USERNAME=" + user.UserName,
 			"GITEA_PRIV_KEY=" + priv,
 			"GITEA_PUB_KEY=" + pub,
-			"GITEA_KEYSCAN=" + sc.keyScan,
+			"GITEA_KEYSCAN=" + p.keyScan,
 		},
 	}
 	for _, repo := range repos {
-		res.Vars = append(res.Vars, fmt.Sprintf("%v=%v/%v/%v", repo.repoSpec.Var, sc.hostname, user.UserName, repo.Name))
+		res.Vars = append(res.Vars, fmt.Sprintf("%v=%v/%v/%v", repo.repoSpec.Var, p.hostname, user.UserName, repo.Name))
 	}
+	if args.GoEnv != nil {
+		res.Vars = append(res.Vars, p.goEnv(args.GoEnv)...)
+	}
+	return res, nil
+}
+
+// recordSession records the newly provisioned user in the store
+func (p *provisioner) recordSession(ctx context.Context, user *userPassword, repos []userRepo, fingerprint string) error {
+	ac := auditContextOf(ctx)
+	now := time.Now()
+	sess := &session{
+		ID:        newSessionID(),
+		RequestID: ac.requestID,
+		Caller:    ac.caller,
+		User:      user.UserName,
+		Keys:      []string{fingerprint},
+		Created:   now,
+		Expires:   now.Add(*p.fSessionTTL),
+	}
+	for _, repo := range repos {
+		sess.Repos = append(sess.Repos, repo.Name)
+	}
+	sort.Strings(sess.Repos)
+	if err := p.store.putSession(sess); err != nil {
+		return fmt.Errorf("failed to record session: %v", err)
+	}
+	logger(ctx).Info("recorded session", "session", sess.ID, "user", user.UserName, "expires", sess.Expires)
+	return nil
+}
+
+// abandonedErr returns an error if ctx has been cancelled, abandoning the
+// provisioning of a user
+func abandonedErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("provisioning abandoned: %v", err)
+	}
+	return nil
+}
+
+// removeUser removes username and all of their repositories, recording
+// reason in the audit log
+func (p *provisioner) removeUser(ctx context.Context, username, reason string) error {
+	ctx, span := tracer.Start(ctx, "removeUser", trace.WithAttributes(attribute.String("user", username)))
+	defer span.End()
+	client, err := p.giteaClient(ctx)
+	if err != nil {
+		return err
+	}
+	if err := deleteUser(ctx, client, username); err != nil {
+		return err
+	}
+	p.audit.record(ctx, auditEvent{Event: auditUserReleased, User: username, Reason: reason})
+	return nil
+}
+
+// deleteUser deletes username and all of their repositories via client
+func deleteUser(ctx context.Context, client *giteasdk.Client, username string) error {
+	log := logger(ctx)
+	opt := giteasdk.ListReposOptions{
+		ListOptions: giteasdk.ListOptions{
+			PageSize: 10,
+		},
+	}
+	for {
+		// Always list the first page: we delete as we go
+		repos, _, err := client.ListUserRepos(username, opt)
+		if err != nil {
+			return fmt.Errorf("failed to list repos: %v", err)
+		}
+		for _, repo := range repos {
+			if _, err := client.DeleteRepo(username, repo.Name); err != nil {
+				return fmt.Errorf("failed to delete repo %v/%v: %v", username, repo.Name, err)
+			}
+			log.Info("deleted repo", "user", username, "repo", repo.Name)
+		}
+		if len(repos) < opt.PageSize {
+			break
+		}
+	}
+	if _, err := client.AdminDeleteUser(username); err != nil {
+		return fmt.Errorf("failed to delete user: %v", err)
+	}
+	log.Info("deleted user", "user", username)
+	return nil
+}
+
+// goEnv returns the Go toolchain and git environment variables that allow
+// repositories on the Gitea instance to be used as Go modules via ssh
+func (sc *serveCmd) goEnv(spec *gitea.GoEnv) []string {
+	res := []string{
+		"GOPRIVATE=" + sc.hostname,
+		"GONOPROXY=" + sc.hostname,
+		"GONOSUMDB=" + sc.hostname,
+	}
+	if spec.Flags != "" {
+		res = append(res, "GOFLAGS="+spec.Flags)
+	}
+	sshCmd := "ssh -o IdentitiesOnly=yes"
+	if spec.KeyPath != "" {
+		sshCmd += " -i " + shellQuote(spec.KeyPath)
+	}
+	if spec.KnownHostsPath != "" {
+		sshCmd += " -o UserKnownHostsFile=" + shellQuote(spec.KnownHostsPath)
+	}
+	res = append(res,
+		"GIT_SSH_COMMAND="+sshCmd,
+		"GIT_CONFIG_COUNT=1",
+		fmt.Sprintf("GIT_CONFIG_KEY_0=url.ssh://git@%v/.insteadOf", sc.hostname),
+		fmt.Sprintf("GIT_CONFIG_VALUE_0=https://%v/", sc.hostname),
+	)
 	return res
 }
 
+// shellQuote double-quotes s for use as a word of GIT_SSH_COMMAND, which git
+// runs via the shell. Environment variables, such as the $HOME of the default
+// paths of gitea.GoEnv, are still expanded.
+func shellQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`").Replace(s) + `"`
+}
+
+// giteaClient returns a client, authenticated as the contributor, whose
+// requests are made within ctx and so are traced as children of its span.
+// Each call returns a new client, which is therefore not shared between
+// requests. Creating the client makes no requests: the server version is
+// that found when serve started.
+func (p *provisioner) giteaClient(ctx context.Context) (*giteasdk.Client, error) {
+	user, password := p.contributorCredentials()
+	client, err := giteasdk.NewClient(*p.fRootURL,
+		giteasdk.SetHTTPClient(p.httpClient),
+		giteasdk.SetBasicAuth(user, password),
+		giteasdk.SetGiteaVersion(p.giteaVersion),
+		giteasdk.SetContext(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %v", err)
+	}
+	return client, nil
+}
+
 type userPassword struct {
 	*giteasdk.User
 	password string
 }
 
-var start = time.Date(2019, time.December, 19, 12, 00, 0, 0, time.UTC)
+// setupIDs configures the generator of the IDs of users and repositories
+// per the -id* flags
+func (sc *serveCmd) setupIDs() error {
+	ids, err := newIDGenerator(*sc.fIDFormat, *sc.fIDLength, *sc.fIDAlphabet)
+	if err != nil {
+		return err
+	}
+	if !idPrefixRegexp.MatchString(*sc.fIDPrefix) {
+		return fmt.Errorf("invalid -idPrefix %q: must be a-z, 0-9, - or _, starting with a-z or 0-9", *sc.fIDPrefix)
+	}
+	if n := len(*sc.fIDPrefix) + maxIDLength(ids); n > maxUsernameLength {
+		return fmt.Errorf("usernames of up to %d characters would exceed the maximum of %d: use a shorter -idPrefix or -idLength", n, maxUsernameLength)
+	}
+	sc.ids = ids
+	return nil
+}
 
-func (sc *serveCmd) genID() string {
-	now := time.Now()
-	diff := (now.UnixNano() - start.UnixNano()) / 1000000
-	bs := make([]byte, binary.MaxVarintLen64)
-	n := binary.PutVarint(bs, diff)
-	var buf bytes.Buffer
-	enc := hex.NewEncoder(&buf)
-	if _, err := enc.Write(bs[:n]); err != nil {
-		panic(err)
+// Gitea's rules for usernames: a username must match validUsernameRegexp
+// and must not match invalidUsernameRegexp
+var (
+	validUsernameRegexp   = regexp.MustCompile(`^[\da-zA-Z][-.\w]*$`)
+	invalidUsernameRegexp = regexp.MustCompile(`[-._]{2,}|[-._]$`)
+)
+
+// username returns the username given by pattern and id, per
+// gitea.NewUser.UsernamePattern
+func (sc *serveCmd) username(pattern, id string) string {
+	if pattern == "" {
+		return *sc.fIDPrefix + id
+	}
+	if i := strings.LastIndex(pattern, "*"); i != -1 {
+		return pattern[:i] + id + pattern[i+1:]
 	}
-	id := buf.String()
-	id = strings.ToLower(id)
-	return id
+	return pattern + id
 }
 
-func (sc *serveCmd) createUser() *userPassword {
-	var err error
+// checkUsernamePattern returns an error if the usernames given by pattern
+// are not allowed by -usernamePrefixes, or would not be valid Gitea
+// usernames
+func (sc *serveCmd) checkUsernamePattern(pattern string) error {
+	if pattern == "" {
+		return nil
+	}
+	allowed := false
+	for _, p := range splitList(*sc.fUsernamePrefixes) {
+		if strings.HasPrefix(pattern, p) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("username pattern %q does not begin with an allowed prefix", pattern)
+	}
+	if n := len(sc.username(pattern, "")) + maxIDLength(sc.ids); n > maxUsernameLength {
+		return fmt.Errorf("username pattern %q gives usernames of up to %d characters; the maximum is %d", pattern, n, maxUsernameLength)
+	}
+	if u := sc.username(pattern, sc.ids.newID()); !validUsernameRegexp.MatchString(u) || invalidUsernameRegexp.MatchString(u) {
+		return fmt.Errorf("username pattern %q gives invalid usernames such as %q: usernames may only contain alphanumeric characters, -, _ and ., must start with an alphanumeric character, and must not end with or contain consecutive -, _ or .", pattern, u)
+	}
+	return nil
+}
+
+func (p *provisioner) createUser(ctx context.Context, pattern string) (_ *userPassword, err error) {
+	ctx, span := tracer.Start(ctx, "createUser")
+	defer endSpan(span, &err)
+	log := logger(ctx)
+	client, err := p.giteaClient(ctx)
+	if err != nil {
+		return nil, err
+	}
 	password := randomPassword()
 	// Try 3 times... because 3 is a magic number
 	for i := 0; i < 3; i++ {
 		var user *giteasdk.User
-		username := "u" + sc.genID()
+		username := p.username(pattern, p.ids.newID())
 		no := false
 		zero := 0
 		args := giteasdk.CreateUserOption{
 			FullName:           TemporaryUserFullName,
 			Username:           username,
 			LoginName:          username,
-			Email:              fmt.Sprintf("%v@%v", username, sc.hostname),
+			Email:              fmt.Sprintf("%v@%v", username, p.hostname),
 			Password:           password,
 			MustChangePassword: &no,
 		}
-		user, _, err = sc.client.AdminCreateUser(args)
+		user, _, err = client.AdminCreateUser(args)
 		if err != nil {
+			log.Debug("failed to create user", "user", username, "attempt", i+1, "err", err)
 			continue
 		}
-		_, err = sc.client.AdminEditUser(user.UserName, giteasdk.EditUserOption{
+		_, err = client.AdminEditUser(user.UserName, giteasdk.EditUserOption{
 			Email:                   &user.Email,
 			FullName:                &user.FullName,
 			LoginName:               user.UserName,
@@ -218,54 +920,187 @@ func (sc *serveCmd) createUser() *userPassword {
 			AllowCreateOrganization: &no,
 			AllowGitHook:            &no,
 		})
-		check(err, "failed to edit user %v: %v", user.UserName, err)
-
-		return &userPassword{
+		res := &userPassword{
 			User:     user,
 			password: password,
 		}
+		if err != nil {
+			// Return the user so that it is rolled back
+			return res, fmt.Errorf("failed to edit user %v: %v", user.UserName, err)
+		}
+		log.Info("created user", "user", user.UserName)
+		p.audit.record(ctx, auditEvent{Event: auditUserCreated, User: user.UserName})
+		span.SetAttributes(attribute.String("user", user.UserName))
+		return res, nil
 	}
-	raise("failed to create user: %v", err)
-	return nil
+	return nil, fmt.Errorf("failed to create user: %v", err)
 }
 
-func (sc *serveCmd) createUserRepos(user *userPassword, repos []gitea.Repo) (res []userRepo) {
-repos:
-	for _, repoSpec := range repos {
-		var err error
-		var repo *giteasdk.Repository
-		var prefix, suffix string
-		var hasRandomPart bool
-		if i := strings.LastIndex(repoSpec.Pattern, "*"); i != -1 {
-			hasRandomPart = true
-			prefix, suffix = repoSpec.Pattern[:i], repoSpec.Pattern[i+1:]
-		} else {
-			prefix = repoSpec.Pattern
-		}
-		for j := 0; j < 3; j++ {
-			name := prefix
-			if hasRandomPart {
-				name += sc.genID() + suffix
-			}
-			args := giteasdk.CreateRepoOption{
-				Name:    name,
-				Private: repoSpec.Private,
-			}
-			repo, _, err = sc.client.AdminCreateRepo(user.UserName, args)
-			if err == nil {
-				res = append(res, userRepo{
-					repoSpec:   repoSpec,
-					Repository: repo,
-				})
-				continue repos
+func (p *provisioner) createUserRepos(ctx context.Context, user *userPassword, args *gitea.NewUser) (res []userRepo, err error) {
+	env := newPatternEnv(user.UserName, args.Guide, time.Now(), p.ids.newID)
+	for _, repoSpec := range args.Repos {
+		if err := abandonedErr(ctx); err != nil {
+			return nil, err
+		}
+		repo, err := p.createUserRepo(ctx, user, repoSpec, env)
+		if err != nil {
+			return nil, err
+		}
+		env.repos[repoSpec.Var] = repo.Name
+		res = append(res, repo)
+	}
+	return res, nil
+}
+
+// createUserRepo creates, seeds and protects a repository for user per
+// repoSpec
+func (p *provisioner) createUserRepo(ctx context.Context, user *userPassword, repoSpec gitea.Repo, env patternEnv) (_ userRepo, err error) {
+	ctx, span := tracer.Start(ctx, "createUserRepo", trace.WithAttributes(
+		attribute.String("user", user.UserName),
+		attribute.String("pattern", repoSpec.Pattern),
+	))
+	defer endSpan(span, &err)
+	log := logger(ctx)
+	client, err := p.giteaClient(ctx)
+	if err != nil {
+		return userRepo{}, err
+	}
+	var repo *giteasdk.Repository
+	for j := 0; j < 3; j++ {
+		name, unique, perr := expandPattern(repoSpec.Pattern, env)
+		if perr != nil {
+			return userRepo{}, fmt.Errorf("invalid repository pattern: %v", perr)
+		}
+		args := giteasdk.CreateRepoOption{
+			Name:          name,
+			Private:       repoSpec.Private,
+			Description:   repoSpec.Description,
+			DefaultBranch: repoSpec.DefaultBranch,
+			AutoInit:      repoSpec.AutoInit,
+			Readme:        repoSpec.Readme,
+			Gitignores:    repoSpec.Gitignores,
+			License:       repoSpec.License,
+			TrustModel:    giteasdk.TrustModel(repoSpec.TrustModel),
+		}
+		repo, _, err = client.AdminCreateRepo(user.UserName, args)
+		if err == nil {
+			log.Info("created repo", "user", user.UserName, "repo", repo.Name)
+			p.audit.record(ctx, auditEvent{Event: auditRepoCreated, User: user.UserName, Repo: repo.Name})
+			span.SetAttributes(attribute.String("repo", repo.Name))
+			if err := p.seedUserRepo(ctx, user, repo, repoSpec); err != nil {
+				return userRepo{}, err
 			}
-			if !hasRandomPart {
-				break
+			if err := p.protectUserRepo(ctx, user, repo, repoSpec); err != nil {
+				return userRepo{}, err
 			}
+			return userRepo{
+				repoSpec:   repoSpec,
+				Repository: repo,
+			}, nil
+		}
+		log.Debug("failed to create repo", "user", user.UserName, "repo", name, "attempt", j+1, "err", err)
+		if !unique {
+			break
+		}
+	}
+	return userRepo{}, fmt.Errorf("failed to create user repostitory: %v", err)
+}
+
+// protectUserRepo applies the branch and tag protection rules of repoSpec to
+// the newly created repo
+func (p *provisioner) protectUserRepo(ctx context.Context, user *userPassword, repo *giteasdk.Repository, repoSpec gitea.Repo) error {
+	log := logger(ctx)
+	client, err := p.giteaClient(ctx)
+	if err != nil {
+		return err
+	}
+	for _, bp := range repoSpec.BranchProtections {
+		args := giteasdk.CreateBranchProtectionOption{
+			BranchName:             bp.Branch,
+			EnablePush:             bp.EnablePush,
+			EnablePushWhitelist:    len(bp.PushWhitelist) > 0,
+			PushWhitelistUsernames: bp.PushWhitelist,
+			RequiredApprovals:      int64(bp.RequiredApprovals),
+			EnableStatusCheck:      len(bp.StatusChecks) > 0,
+			StatusCheckContexts:    bp.StatusChecks,
+		}
+		if _, _, err := client.CreateBranchProtection(user.UserName, repo.Name, args); err != nil {
+			return fmt.Errorf("failed to protect branch %v of %v/%v: %v", bp.Branch, user.UserName, repo.Name, err)
 		}
-		raise("failed to create user repostitory: %v", err)
+		log.Info("protected branch", "user", user.UserName, "repo", repo.Name, "branch", bp.Branch)
+	}
+	for _, pt := range repoSpec.ProtectedTags {
+		if err := p.createTagProtection(ctx, user.UserName, repo.Name, pt); err != nil {
+			return fmt.Errorf("failed to protect tags %v of %v/%v: %v", pt.NamePattern, user.UserName, repo.Name, err)
+		}
+		log.Info("protected tags", "user", user.UserName, "repo", repo.Name, "pattern", pt.NamePattern)
+	}
+	return nil
+}
+
+// tagProtectionVersion is the first version of Gitea with an API for tag
+// protection
+var tagProtectionVersion = [2]int{1, 23}
+
+// checkRepoProtections returns an error if the protection rules of the repos
+// of args cannot be applied. Gitea can only protect a branch that exists,
+// which requires the repository to have been initialised, and can only
+// protect tags via the API from tagProtectionVersion on.
+func (p *provisioner) checkRepoProtections(args *gitea.NewUser) error {
+	for _, r := range args.Repos {
+		if len(r.BranchProtections) > 0 && !r.AutoInit {
+			return fmt.Errorf("repository %q: BranchProtections require AutoInit", r.Pattern)
+		}
+		if len(r.ProtectedTags) > 0 && !giteaVersionAtLeast(p.giteaVersion, tagProtectionVersion) {
+			return fmt.Errorf("repository %q: ProtectedTags require Gitea %d.%d or later; found %v", r.Pattern, tagProtectionVersion[0], tagProtectionVersion[1], p.giteaVersion)
+		}
+	}
+	return nil
+}
+
+// giteaVersionAtLeast reports whether the Gitea version v, for example
+// "1.15.9", is at least the major and minor version min. Versions that
+// cannot be parsed are assumed to be older.
+func giteaVersionAtLeast(v string, min [2]int) bool {
+	var major, minor int
+	if _, err := fmt.Sscanf(v, "%d.%d", &major, &minor); err != nil {
+		return false
+	}
+	return major > min[0] || major == min[0] && minor >= min[1]
+}
+
+// createTagProtection creates a tag protection rule on owner/repo. The version
+// of the Gitea SDK we use predates the tag protection API, which was added in
+// Gitea 1.23, hence we make the request directly. Requests with ProtectedTags
+// are rejected for earlier versions: see checkRepoProtections.
+func (sc *serveCmd) createTagProtection(ctx context.Context, owner, repo string, pt gitea.ProtectedTag) error {
+	body, err := json.Marshal(struct {
+		NamePattern        string   `json:"name_pattern"`
+		WhitelistUsernames []string `json:"whitelist_usernames"`
+	}{
+		NamePattern:        pt.NamePattern,
+		WhitelistUsernames: pt.Whitelist,
+	})
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%v/api/v1/repos/%v/%v/tag_protections", strings.TrimSuffix(*sc.fRootURL, "/"), url.PathEscape(owner), url.PathEscape(repo))
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(sc.contributorCredentials())
+	resp, err := sc.httpClient.Do(req)
+	if err != nil {
+		return err
 	}
-	return
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%v: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
 }
 
 type userRepo struct {
@@ -273,35 +1108,58 @@ type userRepo struct {
 	*giteasdk.Repository
 }
 
-func (sc *serveCmd) createUserSSHKey() (string, string) {
-	pub, priv, err := ed25519.GenerateKey(rand.Reader)
-	check(err, "failed to generate ed25519 key: %v", err)
-	privKey := pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: marshalED25519PrivateKey(priv, pub)})
-	check(err, "failed to pem-encode private key: %v", err)
-	pubKey, err := ssh.NewPublicKey(pub)
-	check(err, "failed to create public key: %v", err)
-	authKey := ssh.MarshalAuthorizedKey(pubKey)
-	return string(privKey), string(authKey)
+func (p *provisioner) createUserSSHKey(ctx context.Context) (priv, pub string, err error) {
+	_, span := tracer.Start(ctx, "createUserSSHKey")
+	defer endSpan(span, &err)
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate ed25519 key: %v", err)
+	}
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: marshalED25519PrivateKey(privKey, pubKey)})
+	sshKey, err := ssh.NewPublicKey(pubKey)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create public key: %v", err)
+	}
+	authKey := ssh.MarshalAuthorizedKey(sshKey)
+	return string(privPEM), string(authKey), nil
 }
 
-func (sc *serveCmd) setUserSSHKey(user *userPassword, pub string) {
+// setUserSSHKey uploads the public key pub for user, returning its
+// fingerprint
+func (p *provisioner) setUserSSHKey(ctx context.Context, user *userPassword, pub string) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "setUserSSHKey", trace.WithAttributes(attribute.String("user", user.UserName)))
+	defer endSpan(span, &err)
 	args := giteasdk.CreateKeyOption{
 		Title:    "ssh key",
 		Key:      pub,
 		ReadOnly: false,
 	}
-	_, _, err := sc.client.AdminCreateUserPublicKey(user.UserName, args)
-	check(err, "failed to set user SSH key: %v", err)
+	client, err := p.giteaClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	if _, _, err := client.AdminCreateUserPublicKey(user.UserName, args); err != nil {
+		return "", fmt.Errorf("failed to set user SSH key: %v", err)
+	}
+	logger(ctx).Info("set user SSH key", "user", user.UserName)
+	var fingerprint string
+	if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pub)); err == nil {
+		fingerprint = ssh.FingerprintSHA256(key)
+	}
+	p.audit.record(ctx, auditEvent{Event: auditKeyUploaded, User: user.UserName, Key: fingerprint})
+	return fingerprint, nil
 }
 
-func (sc *serveCmd) runKeyScan() {
+// runKeyScan returns the ssh-keyscan output for the Gitea instance
+func (sc *serveCmd) runKeyScan(ctx context.Context) (string, error) {
 	var stdout, stderr bytes.Buffer
-	cmd := exec.Command("ssh-keyscan", "-H", "gopher.live")
+	cmd := exec.CommandContext(ctx, "ssh-keyscan", "-H", "gopher.live")
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
-	err := cmd.Run()
-	check(err, "failed to run [%v]: %v\n%s", strings.Join(cmd.Args, " "), err, stderr.Bytes())
-	sc.keyScan = strings.TrimSpace(stdout.String())
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to run [%v]: %v\n%s", strings.Join(cmd.Args, " "), err, stderr.Bytes())
+	}
+	return strings.TrimSpace(stdout.String()), nil
 }
 
 // marshalED25519PrivateKey is based on https://github.com/mikesmitty/edkey
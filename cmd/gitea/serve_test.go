@@ -0,0 +1,134 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	giteasdk "code.gitea.io/sdk/gitea"
+	"github.com/play-with-go/gitea"
+)
+
+// TestProtectUserRepo verifies that branch and tag protection rules are
+// created, and that protecting a branch of a repository that was not
+// initialised fails
+func TestProtectUserRepo(t *testing.T) {
+	fake := newFakeGitea(t)
+	gs := httptest.NewServer(fake)
+	defer gs.Close()
+	fake.users["gopher"] = &fakeUser{repos: []string{"init", "bare"}}
+	fake.initialised["gopher/init"] = true
+
+	p := newTestServeCmd(t, gs.URL).newProvisioner("1.23.0", testKeyScan)
+	user := &userPassword{User: &giteasdk.User{UserName: "gopher"}}
+	spec := gitea.Repo{
+		BranchProtections: []gitea.BranchProtection{{Branch: "main", RequiredApprovals: 1}},
+		ProtectedTags:     []gitea.ProtectedTag{{NamePattern: "v*"}},
+	}
+	if err := p.protectUserRepo(context.Background(), user, &giteasdk.Repository{Name: "init"}, spec); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"branch gopher/init main", "tags gopher/init v*"}
+	if !reflect.DeepEqual(fake.protections, want) {
+		t.Errorf("got protections %q; want %q", fake.protections, want)
+	}
+
+	if err := p.protectUserRepo(context.Background(), user, &giteasdk.Repository{Name: "bare"}, spec); err == nil {
+		t.Errorf("protecting a branch of an uninitialised repo succeeded")
+	}
+}
+
+func TestGiteaVersionAtLeast(t *testing.T) {
+	for _, tc := range []struct {
+		v    string
+		want bool
+	}{
+		{"1.15.9", false},
+		{"1.22.6", false},
+		{"1.23.0", true},
+		{"1.23.1+dev-12-gabcdef", true},
+		{"1.100.0", true},
+		{"2.0.0", true},
+		{"development", false},
+	} {
+		if got := giteaVersionAtLeast(tc.v, tagProtectionVersion); got != tc.want {
+			t.Errorf("giteaVersionAtLeast(%q, %v) = %v; want %v", tc.v, tagProtectionVersion, got, tc.want)
+		}
+	}
+}
+
+func TestGoEnv(t *testing.T) {
+	// env returns the variables expected for the GOFLAGS and GIT_SSH_COMMAND
+	// variables vs, which vary with the spec
+	env := func(vs ...string) []string {
+		res := []string{
+			"GOPRIVATE=gopher.live",
+			"GONOPROXY=gopher.live",
+			"GONOSUMDB=gopher.live",
+		}
+		res = append(res, vs...)
+		return append(res,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=url.ssh://git@gopher.live/.insteadOf",
+			"GIT_CONFIG_VALUE_0=https://gopher.live/",
+		)
+	}
+	for _, tc := range []struct {
+		name string
+		spec gitea.GoEnv
+		want []string
+	}{
+		{
+			name: "Empty",
+			want: env(
+				"GIT_SSH_COMMAND=ssh -o IdentitiesOnly=yes",
+			),
+		},
+		{
+			name: "Default",
+			spec: gitea.GoEnv{
+				KeyPath:        "$HOME/.ssh/id_ed25519",
+				KnownHostsPath: "$HOME/.ssh/known_hosts",
+				Flags:          "-mod=mod",
+			},
+			want: env(
+				"GOFLAGS=-mod=mod",
+				`GIT_SSH_COMMAND=ssh -o IdentitiesOnly=yes -i "$HOME/.ssh/id_ed25519" -o UserKnownHostsFile="$HOME/.ssh/known_hosts"`,
+			),
+		},
+		{
+			name: "KeyPathOnly",
+			spec: gitea.GoEnv{KeyPath: "/home/go pher/.ssh/id_ed25519"},
+			want: env(
+				`GIT_SSH_COMMAND=ssh -o IdentitiesOnly=yes -i "/home/go pher/.ssh/id_ed25519"`,
+			),
+		},
+		{
+			name: "KnownHostsPathOnly",
+			spec: gitea.GoEnv{KnownHostsPath: "/tmp/\"known\" `hosts`\\"},
+			want: env(
+				"GIT_SSH_COMMAND=ssh -o IdentitiesOnly=yes -o UserKnownHostsFile=\"/tmp/\\\"known\\\" \\`hosts\\`\\\\\"",
+			),
+		},
+		{
+			name: "FlagsOnly",
+			spec: gitea.GoEnv{Flags: "-mod=mod -trimpath"},
+			want: env(
+				"GOFLAGS=-mod=mod -trimpath",
+				"GIT_SSH_COMMAND=ssh -o IdentitiesOnly=yes",
+			),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sc := newTestServeCmd(t, "https://gopher.live")
+			if got := sc.goEnv(&tc.spec); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got:\n%q\nwant:\n%q", got, tc.want)
+			}
+		})
+	}
+}
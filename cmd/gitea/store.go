@@ -0,0 +1,245 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	giteasdk "code.gitea.io/sdk/gitea"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// bucketSessions maps session ID to the JSON-encoded session
+	bucketSessions = []byte("sessions")
+
+	// bucketUsers maps username to the ID of the session that owns the user
+	bucketUsers = []byte("users")
+)
+
+// session is the record of a user provisioned by serve
+type session struct {
+	ID        string
+	RequestID string `json:",omitempty"`
+	Caller    string `json:",omitempty"`
+	User      string
+	Repos     []string
+	Keys      []string // SHA256 fingerprints
+	Created   time.Time
+	Expires   time.Time
+
+	// Adopted is set for sessions created during reconciliation, for users
+	// found in Gitea that the store did not know about
+	Adopted bool `json:",omitempty"`
+}
+
+// store is the persistent, on-disk record of the sessions created by serve.
+// It is safe for concurrent use.
+type store struct {
+	db *bolt.DB
+}
+
+// openStore opens, creating if necessary, the store in the file path. Only
+// one process can have the store open at a time.
+func openStore(path string) (*store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketSessions, bucketUsers} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialise %v: %v", path, err)
+	}
+	return &store{db: db}, nil
+}
+
+func (s *store) close() error {
+	return s.db.Close()
+}
+
+// putSession creates or replaces sess
+func (s *store) putSession(sess *session) error {
+	b, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketSessions).Put([]byte(sess.ID), b); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketUsers).Put([]byte(sess.User), []byte(sess.ID))
+	})
+}
+
+// deleteSession removes the session with the given ID, if it exists
+func (s *store) deleteSession(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket(bucketSessions)
+		v := sessions.Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		var sess session
+		if err := json.Unmarshal(v, &sess); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketUsers).Delete([]byte(sess.User)); err != nil {
+			return err
+		}
+		return sessions.Delete([]byte(id))
+	})
+}
+
+// sessionByUser returns the session that owns username, or nil if there is
+// none
+func (s *store) sessionByUser(username string) (*session, error) {
+	var res *session
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(bucketUsers).Get([]byte(username))
+		if id == nil {
+			return nil
+		}
+		v := tx.Bucket(bucketSessions).Get(id)
+		if v == nil {
+			return nil
+		}
+		res = new(session)
+		return json.Unmarshal(v, res)
+	})
+	return res, err
+}
+
+// sessions returns all sessions, ordered by ID
+func (s *store) sessions() ([]*session, error) {
+	var res []*session
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSessions).ForEach(func(k, v []byte) error {
+			sess := new(session)
+			if err := json.Unmarshal(v, sess); err != nil {
+				return fmt.Errorf("failed to decode session %s: %v", k, err)
+			}
+			res = append(res, sess)
+			return nil
+		})
+	})
+	return res, err
+}
+
+// newSessionID returns a new random session ID
+func newSessionID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	check(err, "failed to read a random stream of bytes: %v", err)
+	return hex.EncodeToString(b)
+}
+
+// reconcile repairs any drift between the store and the temporary users in
+// Gitea, which can arise if serve stops part way through provisioning, or
+// users are deleted by reap or by hand. Sessions whose user no longer exists
+// are removed; the repos and keys of the remaining sessions are refreshed
+// from Gitea; and temporary users unknown to the store are adopted, expiring
+// -sessionTTL after they were created.
+func (p *provisioner) reconcile(ctx context.Context) (err error) {
+	defer handleKnown(&err)
+	log := logger(ctx)
+	client, err := p.giteaClient(ctx)
+	check(err, "%v", err)
+
+	live := make(map[string]*giteasdk.User)
+	forEachTemporaryUser(client, func(user *giteasdk.User) {
+		live[user.UserName] = user
+	})
+
+	sessions, err := p.store.sessions()
+	check(err, "failed to read sessions: %v", err)
+	for _, sess := range sessions {
+		if _, ok := live[sess.User]; !ok {
+			err := p.store.deleteSession(sess.ID)
+			check(err, "failed to delete session %v: %v", sess.ID, err)
+			log.Info("removed session of missing user", "session", sess.ID, "user", sess.User)
+			continue
+		}
+		delete(live, sess.User)
+		repos, keys := p.userResources(client, sess.User)
+		if equalStrings(repos, sess.Repos) && equalStrings(keys, sess.Keys) {
+			continue
+		}
+		sess.Repos, sess.Keys = repos, keys
+		err := p.store.putSession(sess)
+		check(err, "failed to update session %v: %v", sess.ID, err)
+		log.Info("repaired session", "session", sess.ID, "user", sess.User)
+	}
+
+	for _, user := range live {
+		repos, keys := p.userResources(client, user.UserName)
+		sess := &session{
+			ID:      newSessionID(),
+			User:    user.UserName,
+			Repos:   repos,
+			Keys:    keys,
+			Created: user.Created,
+			Expires: user.Created.Add(*p.fSessionTTL),
+			Adopted: true,
+		}
+		err := p.store.putSession(sess)
+		check(err, "failed to create session for %v: %v", user.UserName, err)
+		log.Info("adopted user", "session", sess.ID, "user", user.UserName)
+	}
+	return nil
+}
+
+// userResources returns the sorted names of the repos, and fingerprints of
+// the keys, of username in Gitea
+func (sc *serveCmd) userResources(client *giteasdk.Client, username string) (repos, keys []string) {
+	forEachUserRepo(client, username, func(r *giteasdk.Repository) {
+		repos = append(repos, r.Name)
+	})
+	kopt := giteasdk.ListPublicKeysOptions{
+		ListOptions: giteasdk.ListOptions{
+			Page:     1,
+			PageSize: 10,
+		},
+	}
+	for {
+		ks, _, err := client.ListPublicKeys(username, kopt)
+		check(err, "failed to list keys of %v: %v", username, err)
+		for _, k := range ks {
+			keys = append(keys, k.Fingerprint)
+		}
+		if len(ks) < kopt.PageSize {
+			break
+		}
+		kopt.Page++
+	}
+	sort.Strings(repos)
+	sort.Strings(keys)
+	return repos, keys
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestReconcile verifies that reconciliation removes sessions for users that
+// no longer exist, repairs sessions whose repos have drifted, and adopts
+// temporary users unknown to the store.
+func TestReconcile(t *testing.T) {
+	reply := func(resp http.ResponseWriter, v interface{}) {
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(v)
+	}
+	created := time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+	fake := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/v1/admin/users":
+			reply(resp, []interface{}{
+				map[string]interface{}{"login": "contributor", "full_name": "A contributor"},
+				map[string]interface{}{"login": "uknown", "full_name": TemporaryUserFullName, "created": created},
+				map[string]interface{}{"login": "unew", "full_name": TemporaryUserFullName, "created": created},
+			})
+		case "/api/v1/users/uknown/repos":
+			reply(resp, []interface{}{
+				map[string]interface{}{"name": "mod2"},
+				map[string]interface{}{"name": "mod1"},
+			})
+		case "/api/v1/users/unew/repos":
+			reply(resp, []interface{}{})
+		case "/api/v1/users/uknown/keys", "/api/v1/users/unew/keys":
+			reply(resp, []interface{}{
+				map[string]interface{}{"fingerprint": "SHA256:abc"},
+			})
+		default:
+			t.Errorf("fake gitea: unexpected request %v %v", req.Method, req.URL.Path)
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer fake.Close()
+
+	sc := newTestServeCmd(t, fake.URL)
+	var err error
+	sc.store, err = openStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.store.close()
+
+	for _, sess := range []*session{
+		{ID: "known", User: "uknown", Repos: []string{"mod1"}, Keys: []string{"SHA256:abc"}},
+		{ID: "gone", User: "ugone", Repos: []string{"mod1"}},
+	} {
+		if err := sc.store.putSession(sess); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := newTestProvisioner(sc).reconcile(withLogger(context.Background(), sc.logger)); err != nil {
+		t.Fatalf("failed to reconcile: %v", err)
+	}
+
+	if sess, err := sc.store.sessionByUser("ugone"); err != nil || sess != nil {
+		t.Errorf("session for ugone: got %v, %v; want none", sess, err)
+	}
+	sess, err := sc.store.sessionByUser("uknown")
+	if err != nil || sess == nil {
+		t.Fatalf("session for uknown: got %v, %v", sess, err)
+	}
+	if sess.ID != "known" || !equalStrings(sess.Repos, []string{"mod1", "mod2"}) {
+		t.Errorf("session for uknown not repaired: %+v", sess)
+	}
+	sess, err = sc.store.sessionByUser("unew")
+	if err != nil || sess == nil {
+		t.Fatalf("session for unew: got %v, %v", sess, err)
+	}
+	if !sess.Adopted || !sess.Expires.Equal(created.Add(*sc.fSessionTTL)) || !equalStrings(sess.Keys, []string{"SHA256:abc"}) {
+		t.Errorf("session for unew not adopted as expected: %+v", sess)
+	}
+	all, err := sc.store.sessions()
+	if err != nil || len(all) != 2 {
+		t.Errorf("got sessions %v, %v; want 2", all, err)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/play-with-go/gitea"
+	"github.com/play-with-go/preguide"
+)
+
+// TestConcurrentNewUser provisions many users concurrently, via all versions
+// of the API, against a fake Gitea instance, with requests arriving before
+// the server is ready. It is intended to be run with -race, as it is in CI,
+// and so it runs the whole of server.init, which publishes the state shared
+// by the handlers.
+func TestConcurrentNewUser(t *testing.T) {
+	const n = 60
+	paths := []string{"/newuser", "/v1/newuser", "/v2/newuser"}
+
+	fake := httptest.NewServer(newFakeGitea(t))
+	defer fake.Close()
+	sc := newTestServeCmd(t, fake.URL)
+	var err error
+	sc.store, err = openStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.store.close()
+
+	// The keyscan completes only once all the requests have been started,
+	// so that they wait for init
+	release := make(chan int)
+	sc.keyScan = func(ctx context.Context) (string, error) {
+		select {
+		case <-release:
+			return testKeyScan, nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	s := sc.newServer(context.Background(), context.Background())
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+	go s.init()
+
+	body, err := json.Marshal(contractRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usernames := make(chan string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		path := paths[i%len(paths)]
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Post(srv.URL+path, "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Errorf("%v: %v", path, err)
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("%v: got status %v", path, resp.StatusCode)
+				return
+			}
+			var sess *gitea.Session
+			if path == "/v2/newuser" {
+				err = json.NewDecoder(resp.Body).Decode(&sess)
+			} else {
+				var res preguide.PrestepOut
+				if err = json.NewDecoder(resp.Body).Decode(&res); err == nil {
+					sess, err = gitea.ParseSession(contractRequest, res.Vars)
+				}
+			}
+			if err != nil {
+				t.Errorf("%v: failed to decode response: %v", path, err)
+				return
+			}
+			usernames <- sess.Username
+		}()
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(srv.URL + "/v1/version")
+			if err != nil {
+				t.Errorf("/v1/version: %v", err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("/v1/version: got status %v", resp.StatusCode)
+			}
+		}()
+	}
+
+	close(release)
+
+	wg.Wait()
+	close(usernames)
+	seen := make(map[string]bool)
+	for u := range usernames {
+		if seen[u] {
+			t.Errorf("username %v provisioned more than once", u)
+		}
+		seen[u] = true
+	}
+	if len(seen) != n {
+		t.Errorf("got %d users; want %d", len(seen), n)
+	}
+	sessions, err := sc.store.sessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != n {
+		t.Errorf("got %d sessions; want %d", len(sessions), n)
+	}
+}
+
+// TestNewUserDuringReconcile makes requests while init reconciles the store
+// with Gitea, and verifies that reconcile neither removes nor adopts the users
+// they create. The listing of users by reconcile is held once it has been
+// taken, such that users created concurrently would be missing from it. Like
+// TestConcurrentNewUser, it is intended to be run with -race.
+func TestNewUserDuringReconcile(t *testing.T) {
+	const n = 10
+
+	fake := newFakeGitea(t)
+	fake.users["uorphan"] = &fakeUser{created: time.Now().Add(-time.Hour)}
+	listed := make(chan int)
+	release := make(chan int)
+	var once sync.Once
+	gs := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" || req.URL.Path != "/api/v1/admin/users" {
+			fake.ServeHTTP(resp, req)
+			return
+		}
+		rec := httptest.NewRecorder()
+		fake.ServeHTTP(rec, req)
+		once.Do(func() {
+			close(listed)
+			<-release
+		})
+		for k, v := range rec.Header() {
+			resp.Header()[k] = v
+		}
+		resp.WriteHeader(rec.Code)
+		resp.Write(rec.Body.Bytes())
+	}))
+	defer gs.Close()
+
+	sc := newTestServeCmd(t, gs.URL)
+	var err error
+	sc.store, err = openStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.store.close()
+	if err := sc.store.putSession(&session{ID: "gone", User: "ugone"}); err != nil {
+		t.Fatal(err)
+	}
+	sc.keyScan = func(ctx context.Context) (string, error) {
+		return testKeyScan, nil
+	}
+	s := sc.newServer(context.Background(), context.Background())
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+	go s.init()
+	<-listed
+
+	body, err := json.Marshal(contractRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usernames := make(chan string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Post(srv.URL+"/v2/newuser", "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			var sess gitea.Session
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("got status %v", resp.StatusCode)
+			} else if err := json.NewDecoder(resp.Body).Decode(&sess); err != nil {
+				t.Errorf("failed to decode response: %v", err)
+			} else {
+				usernames <- sess.Username
+			}
+		}()
+	}
+	done := make(chan int)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// Requests must wait for reconcile. Give them the chance not to.
+	select {
+	case <-done:
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(release)
+	<-done
+	close(usernames)
+
+	for u := range usernames {
+		sess, err := sc.store.sessionByUser(u)
+		if err != nil || sess == nil || sess.Adopted {
+			t.Errorf("session for %v: got %+v, %v; want one created by its request", u, sess, err)
+		}
+	}
+	if sess, err := sc.store.sessionByUser("uorphan"); err != nil || sess == nil || !sess.Adopted {
+		t.Errorf("session for uorphan: got %+v, %v; want adopted", sess, err)
+	}
+	if sess, err := sc.store.sessionByUser("ugone"); err != nil || sess != nil {
+		t.Errorf("session for ugone: got %+v, %v; want none", sess, err)
+	}
+	if sessions, err := sc.store.sessions(); err != nil || len(sessions) != n+1 {
+		t.Errorf("got %d sessions, %v; want %d", len(sessions), err, n+1)
+	}
+}
+
+// TestServeInitFailure verifies that serve exits with an error, rather than
+// failing every request, if it cannot find the properties of the Gitea
+// instance
+func TestServeInitFailure(t *testing.T) {
+	fake := httptest.NewServer(newFakeGitea(t))
+	defer fake.Close()
+	sc := newTestServeCmd(t, fake.URL)
+	sc.keyScan = func(ctx context.Context) (string, error) {
+		return "", fmt.Errorf("ssh-keyscan failed")
+	}
+	err := func() (err error) {
+		defer handleKnown(&err)
+		return sc.run([]string{"-port", "0"})
+	}()
+	if err == nil || !strings.Contains(err.Error(), "failed to initialise: ssh-keyscan failed") {
+		t.Errorf("got error %v; want failure to initialise", err)
+	}
+}
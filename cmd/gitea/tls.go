@@ -0,0 +1,127 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsReloader provides the TLS configuration for serve, built from a
+// certificate, key and optional client CA file. The configuration is rebuilt
+// whenever any of the files change, so certificates can be rotated without a
+// restart. If a rebuild fails (for example because only one of the
+// certificate and key has been replaced so far) the previous configuration
+// continues to be used, and the rebuild is retried on a later handshake.
+// The files are checked for changes at most once per interval.
+type tlsReloader struct {
+	logger       *slog.Logger
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	interval     time.Duration
+
+	mu        sync.Mutex
+	config    *tls.Config
+	modTimes  []time.Time
+	lastCheck time.Time
+}
+
+// tlsReloadInterval is the default interval at which a tlsReloader checks
+// its files for changes
+const tlsReloadInterval = time.Second
+
+func newTLSReloader(logger *slog.Logger, certFile, keyFile, clientCAFile string) (*tlsReloader, error) {
+	tr := &tlsReloader{
+		logger:       logger,
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		interval:     tlsReloadInterval,
+	}
+	if err := tr.maybeReload(); err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+// tlsConfig returns the configuration to use for a TLS listener
+func (tr *tlsReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: tr.getConfigForClient,
+	}
+}
+
+func (tr *tlsReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if now := time.Now(); now.Sub(tr.lastCheck) >= tr.interval {
+		tr.lastCheck = now
+		if err := tr.maybeReload(); err != nil {
+			tr.logger.Error("failed to reload TLS configuration; continuing with previous", "err", err)
+		}
+	}
+	return tr.config, nil
+}
+
+func (tr *tlsReloader) files() []string {
+	res := []string{tr.certFile, tr.keyFile}
+	if tr.clientCAFile != "" {
+		res = append(res, tr.clientCAFile)
+	}
+	return res
+}
+
+// maybeReload rebuilds the configuration if any of the files have changed
+// since it was last built. tr.mu must be held, except during construction.
+func (tr *tlsReloader) maybeReload() error {
+	files := tr.files()
+	modTimes := make([]time.Time, len(files))
+	changed := tr.config == nil
+	for i, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[i] = fi.ModTime()
+		if !changed && !modTimes[i].Equal(tr.modTimes[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(tr.certFile, tr.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate and key: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if tr.clientCAFile != "" {
+		pem, err := os.ReadFile(tr.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("failed to find any certificates in client CA file %v", tr.clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if tr.config != nil {
+		tr.logger.Info("reloaded TLS configuration")
+	}
+	tr.config = config
+	tr.modTimes = modTimes
+	return nil
+}
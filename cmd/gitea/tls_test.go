@@ -0,0 +1,202 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and its key, in PEM form, for use in tests
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert returns a certificate for name signed by parent, or
+// self-signed if parent is nil. isCA indicates whether the certificate may
+// sign others.
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// write writes c to certFile and keyFile, with a modification time of mtime
+func (c *testCert) write(t *testing.T, certFile, keyFile string, mtime time.Time) {
+	for f, b := range map[string][]byte{certFile: c.certPEM, keyFile: c.keyPEM} {
+		if err := os.WriteFile(f, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTLSTestServer starts a server that listens with the TLS configuration
+// of tr
+func newTLSTestServer(t *testing.T, tr *tlsReloader) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+	srv.Listener = tls.NewListener(srv.Listener, tr.tlsConfig())
+	// Rejected handshakes are expected
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Minute)
+	newTestCert(t, "first", nil, false).write(t, certFile, keyFile, start)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tr, err := newTLSReloader(logger, certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.interval = 0
+	srv := newTLSTestServer(t, tr)
+
+	serverName := func() string {
+		conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if got := serverName(); got != "first" {
+		t.Fatalf("got certificate for %v; want first", got)
+	}
+
+	// A certificate that does not match the key is not used
+	second := newTestCert(t, "second", nil, false)
+	if err := os.WriteFile(certFile, second.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := serverName(); got != "first" {
+		t.Errorf("got certificate for %v while only the certificate was rotated; want first", got)
+	}
+
+	second.write(t, certFile, keyFile, start.Add(time.Second))
+	if got := serverName(); got != "second" {
+		t.Errorf("got certificate for %v after rotation; want second", got)
+	}
+
+	// Changes are not seen until the interval has passed
+	tr.interval = time.Hour
+	tr.lastCheck = time.Now()
+	newTestCert(t, "third", nil, false).write(t, certFile, keyFile, start.Add(2*time.Second))
+	if got := serverName(); got != "second" {
+		t.Errorf("got certificate for %v within the reload interval; want second", got)
+	}
+}
+
+func TestTLSClientCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	server := newTestCert(t, "server", nil, false)
+	server.write(t, certFile, keyFile, time.Now())
+	ca := newTestCert(t, "ca", nil, true)
+	if err := os.WriteFile(caFile, ca.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tr, err := newTLSReloader(logger, certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTLSTestServer(t, tr)
+	url := strings.Replace(srv.URL, "http://", "https://", 1)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.cert)
+	get := func(certs ...tls.Certificate) error {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}}
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	keyPair := func(c *testCert) tls.Certificate {
+		cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	if err := get(); err == nil {
+		t.Errorf("request without a client certificate succeeded")
+	}
+	if err := get(keyPair(newTestCert(t, "stranger", nil, false))); err == nil {
+		t.Errorf("request with an untrusted client certificate succeeded")
+	}
+	if err := get(keyPair(newTestCert(t, "client", ca, false))); err != nil {
+		t.Errorf("request with a trusted client certificate failed: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is used to create all spans. Until setupTracing is called it is a
+// no-op.
+var tracer = otel.Tracer("github.com/play-with-go/gitea/cmd/gitea")
+
+// setupTracing installs a tracer provider that exports spans over OTLP/HTTP
+// to the endpoint URL (e.g. http://localhost:4318; the path defaults to the
+// standard /v1/traces), and the W3C trace context propagator. Requests made
+// via r.httpClient are traced as children of the span in their context. The
+// returned function flushes any pending spans and shuts down the provider.
+func (r *runner) setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %v", err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	exp, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "gitea"))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	next := r.httpClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	r.httpClient.Transport = otelhttp.NewTransport(next)
+	return tp.Shutdown, nil
+}
+
+// endSpan ends span, first recording *err against it if non-nil. It is
+// intended to be deferred by a function with a named error result.
+func endSpan(span trace.Span, err *error) {
+	if *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
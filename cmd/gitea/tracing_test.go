@@ -0,0 +1,129 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/play-with-go/gitea"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestTracing provisions a user against a fake Gitea instance, exporting
+// traces to a local OTLP collector, and verifies that the expected spans are
+// exported as part of the caller's trace.
+func TestTracing(t *testing.T) {
+	var mu sync.Mutex
+	var spans []*tracepb.Span
+	collector := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" {
+			t.Errorf("collector: unexpected request for %v", req.URL.Path)
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("collector: failed to read request: %v", err)
+			return
+		}
+		var export coltracepb.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &export); err != nil {
+			t.Errorf("collector: failed to decode request: %v", err)
+			return
+		}
+		mu.Lock()
+		for _, rs := range export.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+		mu.Unlock()
+		b, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+		resp.Header().Set("Content-Type", "application/x-protobuf")
+		resp.Write(b)
+	}))
+	defer collector.Close()
+
+	fake := httptest.NewServer(newFakeGitea(t))
+	defer fake.Close()
+
+	sc := newTestServeCmd(t, fake.URL)
+	shutdown, err := sc.setupTracing(context.Background(), collector.URL)
+	if err != nil {
+		t.Fatalf("failed to set up tracing: %v", err)
+	}
+
+	// Simulate a caller that passes its trace context
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentID = "00f067aa0ba902b7"
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier{
+		"Traceparent": []string{"00-" + traceID + "-" + parentID + "-01"},
+	})
+
+	_, err = newTestProvisioner(sc).newUser(withLogger(ctx, sc.logger), &gitea.NewUser{
+		Repos: []gitea.Repo{
+			{Var: "REPO1", Pattern: "mod1-*"},
+			{Var: "REPO2", Pattern: "mod2-*"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		t.Fatalf("failed to flush traces: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	counts := make(map[string]int)
+	var root *tracepb.Span
+	for _, s := range spans {
+		if got := hex.EncodeToString(s.TraceId); got != traceID {
+			t.Errorf("span %q has trace ID %v; want %v", s.Name, got, traceID)
+		}
+		if s.Name == "newUser" {
+			root = s
+		}
+		name := s.Name
+		if strings.HasPrefix(name, "HTTP ") {
+			name = "HTTP"
+		}
+		counts[name]++
+	}
+	if root == nil {
+		t.Fatalf("no newUser span in %v", counts)
+	}
+	if got := hex.EncodeToString(root.ParentSpanId); got != parentID {
+		t.Errorf("newUser span has parent %v; want %v", got, parentID)
+	}
+	want := map[string]int{
+		"newUser":          1,
+		"createUser":       1,
+		"createUserSSHKey": 1,
+		"setUserSSHKey":    1,
+		"createUserRepo":   2,
+		// create user, edit user, upload key, two repos
+		"HTTP": 5,
+	}
+	for name, n := range want {
+		if counts[name] != n {
+			t.Errorf("got %d %q spans; want %d (all spans: %v)", counts[name], name, n, counts)
+		}
+	}
+}
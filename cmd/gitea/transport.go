@@ -0,0 +1,169 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	giteasdk "code.gitea.io/sdk/gitea"
+)
+
+// maxDebugBody is the maximum number of bytes of a request or response body
+// recorded by debugTransport
+const maxDebugBody = 64 << 10
+
+// newGiteaClient returns a client for the Gitea instance at -rootURL,
+// authenticated as user, with any further options applied. The client uses
+// r.httpClient, and so with -debug its traffic is traced.
+func (r *runner) newGiteaClient(user, password string, opts ...giteasdk.ClientOption) (*giteasdk.Client, error) {
+	opts = append([]giteasdk.ClientOption{
+		giteasdk.SetHTTPClient(r.httpClient),
+		giteasdk.SetBasicAuth(user, password),
+	}, opts...)
+	return giteasdk.NewClient(*r.fRootURL, opts...)
+}
+
+// debugTransport is an http.RoundTripper that logs, at debug level, the Gitea
+// API traffic that passes through it, and optionally dumps it as JSON lines
+// to a file for offline analysis. Bodies are redacted: see redactBody.
+// Traffic is logged with the logger carried by the context of the request,
+// such that it is attributed to the request being handled by serve, if any,
+// else with logger.
+type debugTransport struct {
+	next   http.RoundTripper
+	logger *slog.Logger
+
+	mu   sync.Mutex
+	dump io.Writer
+}
+
+// httpExchange is the record of a single request/response written by
+// debugTransport to its dump file
+type httpExchange struct {
+	Time         time.Time
+	Method       string
+	Path         string
+	Query        string        `json:",omitempty"`
+	Status       int           `json:",omitempty"`
+	Duration     time.Duration // nanoseconds
+	RequestBody  string        `json:",omitempty"`
+	ResponseBody string        `json:",omitempty"`
+	Error        string        `json:",omitempty"`
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	log := loggerOr(req.Context(), t.logger)
+	ex := httpExchange{
+		Time:   time.Now(),
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Query:  req.URL.RawQuery,
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		ex.RequestBody = redactBody(body)
+	}
+	resp, err := t.next.RoundTrip(req)
+	ex.Duration = time.Since(ex.Time)
+	if err != nil {
+		ex.Error = err.Error()
+		t.record(log, ex)
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		ex.Error = err.Error()
+		t.record(log, ex)
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	ex.Status = resp.StatusCode
+	ex.ResponseBody = redactBody(body)
+	t.record(log, ex)
+	return resp, nil
+}
+
+func (t *debugTransport) record(log *slog.Logger, ex httpExchange) {
+	log.Debug("gitea api",
+		"method", ex.Method,
+		"path", ex.Path,
+		"query", ex.Query,
+		"status", ex.Status,
+		"duration", ex.Duration,
+		"request_body", ex.RequestBody,
+		"response_body", ex.ResponseBody,
+		"err", ex.Error,
+	)
+	if t.dump == nil {
+		return
+	}
+	b, err := json.Marshal(ex)
+	if err != nil {
+		log.Error("failed to marshal HTTP exchange", "err", err)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.dump.Write(append(b, '\n')); err != nil {
+		log.Error("failed to write HTTP exchange to dump file", "err", err)
+	}
+}
+
+// redactBody returns the string form of the HTTP body b, truncated to
+// maxDebugBody bytes. For JSON bodies, the values of fields whose names are
+// sensitive (see isSensitiveKey) are redacted; any other body that contains
+// a private key is redacted entirely.
+func redactBody(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err == nil {
+		if rb, err := json.Marshal(redactJSON(v)); err == nil {
+			b = rb
+		}
+	} else if strings.Contains(string(b), "PRIVATE KEY") {
+		return redacted
+	}
+	if len(b) > maxDebugBody {
+		return string(b[:maxDebugBody]) + "...(truncated)"
+	}
+	return string(b)
+}
+
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if isSensitiveKey(k) {
+				v[k] = redacted
+			} else {
+				v[k] = redactJSON(e)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactJSON(e)
+		}
+	case string:
+		if strings.Contains(v, "PRIVATE KEY") {
+			return redacted
+		}
+	}
+	return v
+}
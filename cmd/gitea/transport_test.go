@@ -0,0 +1,98 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedactBody(t *testing.T) {
+	key, err := json.Marshal(testPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		body string
+		want string
+	}{
+		{"Empty", ``, ``},
+		{"JSON", `{"login_name":"gopher","password":"s3cret"}`, `{"login_name":"gopher","password":"REDACTED"}`},
+		{"JSONNested", `{"user":{"name":"gopher","Token":"s3cret"},"items":[{"name":"t","sha1":"s3cret"}]}`, `{"items":[{"name":"t","sha1":"REDACTED"}],"user":{"Token":"REDACTED","name":"gopher"}}`},
+		{"JSONKeyValue", `{"title":"gopher","key":` + string(key) + `}`, `{"key":"REDACTED","title":"gopher"}`},
+		{"JSONArray", `[` + string(key) + `,"ok"]`, `["REDACTED","ok"]`},
+		{"Text", `not found`, `not found`},
+		{"TextKey", `bad key: ` + testPrivateKey, redacted},
+		{"Truncated", strings.Repeat("x", maxDebugBody+1), strings.Repeat("x", maxDebugBody) + "...(truncated)"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := redactBody([]byte(tc.body)); got != tc.want {
+				t.Errorf("got %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestDebugTransport verifies that bodies are passed through unchanged, but
+// logged and dumped redacted, and that traffic is logged with the logger of
+// the request
+func TestDebugTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		io.Copy(resp, req.Body)
+	}))
+	defer srv.Close()
+
+	var log, dump bytes.Buffer
+	logger, err := newLogger(&log, "json", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &debugTransport{
+		next:   http.DefaultTransport,
+		logger: logger,
+		dump:   &dump,
+	}}
+	body := `{"username":"gopher","password":"s3cret"}`
+	ctx := withLogger(context.Background(), logger.With("request_id", "r1234"))
+	req, err := http.NewRequestWithContext(ctx, "POST", srv.URL+"/api/v1/admin/users?x=1", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != body {
+		t.Errorf("got response body %s; want %s", got, body)
+	}
+
+	if strings.Contains(log.String(), "s3cret") {
+		t.Errorf("password logged: %s", log.String())
+	}
+	if !strings.Contains(log.String(), `"msg":"gitea api","request_id":"r1234"`) {
+		t.Errorf("traffic not logged with the request ID: %s", log.String())
+	}
+	var ex httpExchange
+	if err := json.Unmarshal(dump.Bytes(), &ex); err != nil {
+		t.Fatalf("failed to decode dump %q: %v", dump.String(), err)
+	}
+	const want = `{"password":"REDACTED","username":"gopher"}`
+	if ex.Method != "POST" || ex.Path != "/api/v1/admin/users" || ex.Query != "x=1" || ex.Status != http.StatusOK || ex.RequestBody != want || ex.ResponseBody != want {
+		t.Errorf("unexpected exchange dumped: %+v", ex)
+	}
+}
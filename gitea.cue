@@ -11,6 +11,35 @@ _#gitea: preguide.#Prestep & {
 	Args: #NewUser
 }
 
+#NewUser: UsernamePattern: *"" | string
+#NewUser: Guide: *"" | string
+
+#GoEnv: KeyPath: *"$HOME/.ssh/id_ed25519" | string
+#GoEnv: KnownHostsPath: *"$HOME/.ssh/known_hosts" | string
+#GoEnv: Flags: *"-mod=mod" | string
+
 // Establish the default value for the pattern
 #Repo: Pattern: *"*" | string
 #Repo: Private: *false | bool
+#Repo: Description: *"" | string
+#Repo: DefaultBranch: *"main" | string
+#Repo: AutoInit: *false | bool
+#Repo: Readme: *"Default" | string
+#Repo: Gitignores: *"" | string
+#Repo: License: *"" | string
+#Repo: TrustModel: *"default" | "collaborator" | "committer" | "collaboratorcommitter"
+
+#BranchProtection: EnablePush: *false | bool
+#BranchProtection: RequiredApprovals: *0 | int & >=0
+
+#Label: Color: *"#ededed" | =~"^#[0-9a-fA-F]{6}$"
+#Label: Description: *"" | string
+#Milestone: Description: *"" | string
+#Branch: From: *"" | string
+#File: Message: *"" | string
+#Issue: Body: *"" | string
+#Issue: Milestone: *"" | string
+#Issue: Closed: *false | bool
+#PullRequest: Body: *"" | string
+#PullRequest: Base: *"" | string
+#PullRequest: Milestone: *"" | string
@@ -5,18 +5,248 @@
 package gitea
 
 #NewUser: {
+	// UsernamePattern specifies the name pattern of the user. A unique ID
+	// replaces the last "*", or is appended if there is no "*". The pattern
+	// must begin with one of the prefixes allowed by the server. If empty,
+	// the server's default prefix is used.
+	UsernamePattern: string
+
+	// Guide is the name of the guide making the request, used in the
+	// {guide} placeholder of Repo.Pattern
+	Guide: string
+
 	Repos: [...#Repo] @go(,[]Repo)
+
+	// GoEnv, if non-nil, requests that the Go toolchain and git environment
+	// variables required to work with the user's repositories as Go modules
+	// be included in the response
+	GoEnv?: null | #GoEnv @go(,*GoEnv)
+}
+
+// GoEnv configures the Go toolchain and git environment variables included in
+// the response to a NewUser request. The variables returned are:
+//
+//	GOPRIVATE, GONOPROXY, GONOSUMDB - the Gitea instance hostname
+//	GOFLAGS                         - Flags, if non-empty
+//	GIT_SSH_COMMAND                 - ssh using KeyPath and KnownHostsPath
+//	GIT_CONFIG_COUNT, GIT_CONFIG_KEY_0, GIT_CONFIG_VALUE_0
+//	                                - a url.insteadOf rewrite of https
+//	                                  URLs for the instance to ssh
+#GoEnv: {
+	// KeyPath is the path to which the guide writes the user's private key
+	// (GITEA_PRIV_KEY)
+	KeyPath: string
+
+	// KnownHostsPath is the path to which the guide writes the instance's
+	// keyscan (GITEA_KEYSCAN)
+	KnownHostsPath: string
+
+	// Flags is the value of GOFLAGS
+	Flags: string
 }
 
 #Repo: {
 	// Var is the variable name to use for the repository
 	Var: string
 
-	// Pattern specifies the name pattern of the repository. The respository
-	// name is generated by taking Pattern and applying a random string to the
-	// end. If Pattern includes a "*", the random string replaces the last "*"
+	// Pattern specifies the name pattern of the repository. The last "*" in
+	// Pattern is replaced by a unique ID, as are the following placeholders:
+	//
+	//	{id}       - a unique ID
+	//	{user}     - the username of the user
+	//	{guide}    - NewUser.Guide, which must then be set
+	//	{date}     - the UTC date of the request, in the form 20060102
+	//	{var:NAME} - the name of the repository with Var NAME, which must
+	//	             precede this one in NewUser.Repos
+	//
+	// For example, "{user}-hello-{id}".
 	Pattern: string
 
 	// Private indicates whether the repo should be private or not
 	Private: bool
+
+	// Description is the description of the repository
+	Description: string
+
+	// DefaultBranch is the name of the default branch of the repository
+	DefaultBranch: string
+
+	// AutoInit indicates whether the repository should be initialised with an
+	// initial commit containing a README, and the .gitignore and license
+	// specified by Gitignores and License
+	AutoInit: bool
+
+	// Readme is the name of the README template to use when AutoInit is set
+	Readme: string
+
+	// Gitignores is a comma-separated list of .gitignore templates to use
+	// when AutoInit is set
+	Gitignores: string
+
+	// License is the name of the license template to use when AutoInit is
+	// set
+	License: string
+
+	// TrustModel specifies how git signatures are handled in the repository.
+	// One of "default", "collaborator", "committer" or
+	// "collaboratorcommitter"
+	TrustModel: string
+
+	// BranchProtections is the list of branch protection rules applied to the
+	// repository once it has been created
+	BranchProtections: [...#BranchProtection] @go(,[]BranchProtection)
+
+	// ProtectedTags is the list of tag protection rules applied to the
+	// repository once it has been created. Tag protection requires Gitea 1.23
+	// or later: requests that set ProtectedTags are rejected otherwise
+	ProtectedTags: [...#ProtectedTag] @go(,[]ProtectedTag)
+
+	// Content is the content seeded into the repository once it has been
+	// created
+	Content: #RepoContent
+}
+
+// BranchProtection is a branch protection rule. Gitea can only protect a
+// branch that exists, hence branch protection requires the repository to
+// have been initialised via Repo.AutoInit, and Branch to be either its
+// default branch or one of Content.Branches. Requests with BranchProtections
+// but without AutoInit are rejected.
+#BranchProtection: {
+	// Branch is the name of the branch to protect
+	Branch: string
+
+	// EnablePush indicates whether pushing to the branch is allowed at all. If
+	// false, changes can only reach the branch via pull requests
+	EnablePush: bool
+
+	// PushWhitelist restricts pushing to the branch to the listed usernames.
+	// Only relevant when EnablePush is set
+	PushWhitelist: [...string] @go(,[]string)
+
+	// RequiredApprovals is the number of approvals required before a pull
+	// request can be merged into the branch
+	RequiredApprovals: int
+
+	// StatusChecks is the list of status check contexts that must pass before
+	// a pull request can be merged into the branch
+	StatusChecks: [...string] @go(,[]string)
+}
+
+#ProtectedTag: {
+	// NamePattern is the tag name, glob pattern or regular expression
+	// (surrounded by "/") of the tags to protect
+	NamePattern: string
+
+	// Whitelist is the list of usernames allowed to create, update or delete
+	// matching tags. If empty, nobody can
+	Whitelist: [...string] @go(,[]string)
+}
+
+// RepoContent describes the content seeded into a repository. Items are
+// created in the order labels, milestones, branches, issues and then pull
+// requests, all authored by the contributor account. Issues and pull requests
+// are therefore numbered in the order in which they are declared, issues
+// first.
+#RepoContent: {
+	// Labels is the list of labels to create
+	Labels: [...#Label] @go(,[]Label)
+
+	// Milestones is the list of milestones to create
+	Milestones: [...#Milestone] @go(,[]Milestone)
+
+	// Branches is the list of branches to create. Branches require the
+	// repository to have been initialised via Repo.AutoInit
+	Branches: [...#Branch] @go(,[]Branch)
+
+	// Issues is the list of issues to create
+	Issues: [...#Issue] @go(,[]Issue)
+
+	// PullRequests is the list of pull requests to open
+	PullRequests: [...#PullRequest] @go(,[]PullRequest)
+}
+
+#Label: {
+	// Name is the name of the label
+	Name: string
+
+	// Color is the color of the label, in the form "#00aabb"
+	Color: string
+
+	// Description is the description of the label
+	Description: string
+}
+
+#Milestone: {
+	// Title is the title of the milestone
+	Title: string
+
+	// Description is the description of the milestone
+	Description: string
+}
+
+#Branch: {
+	// Name is the name of the branch
+	Name: string
+
+	// From is the name of the branch from which the branch is created. If
+	// empty, the default branch of the repository is used
+	From: string
+
+	// Files is the list of files committed to the branch once it has been
+	// created, one commit per file
+	Files: [...#File] @go(,[]File)
+}
+
+#File: {
+	// Path is the path of the file within the repository
+	Path: string
+
+	// Content is the content of the file
+	Content: string
+
+	// Message is the commit message. If empty, Gitea uses a default message
+	Message: string
+}
+
+#Issue: {
+	// Title is the title of the issue
+	Title: string
+
+	// Body is the body of the issue
+	Body: string
+
+	// Labels is the list of names of labels to apply to the issue, each of
+	// which must be declared in RepoContent.Labels
+	Labels: [...string] @go(,[]string)
+
+	// Milestone is the title of the milestone to which the issue belongs,
+	// which must be declared in RepoContent.Milestones
+	Milestone: string
+
+	// Closed indicates whether the issue should be created closed
+	Closed: bool
+}
+
+#PullRequest: {
+	// Title is the title of the pull request
+	Title: string
+
+	// Body is the body of the pull request
+	Body: string
+
+	// Head is the name of the branch containing the changes, typically one of
+	// RepoContent.Branches
+	Head: string
+
+	// Base is the name of the branch into which the changes are to be merged.
+	// If empty, the default branch of the repository is used
+	Base: string
+
+	// Labels is the list of names of labels to apply to the pull request,
+	// each of which must be declared in RepoContent.Labels
+	Labels: [...string] @go(,[]string)
+
+	// Milestone is the title of the milestone to which the pull request
+	// belongs, which must be declared in RepoContent.Milestones
+	Milestone: string
 }
@@ -7,7 +7,7 @@ workflows: [
 	{file: "test.yml", schema: test},
 ]
 
-_#latestGo:     "1.19.1"
+_#latestGo:     "1.21.x"
 _#ubuntuLatest: "ubuntu-22.04"
 
 test: json.#Workflow & {
@@ -60,6 +60,10 @@ test: json.#Workflow & {
 				run:  "go test ./..."
 				env: CGO_ENABLED: "0"
 			},
+			{
+				name: "Race test"
+				run:  "go test -race ./cmd/gitea"
+			},
 			{
 				name: "staticcheck"
 				run:  "go run honnef.co/go/tools/cmd/staticcheck ./..."